@@ -0,0 +1,341 @@
+package gamma
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AccessDenied     = "denied"
+	AccessNotAllowed = "not_allowed"
+	AccessBanned     = "banned"
+	// AccessProxy rejects players by the access lists of the proxy they join
+	AccessProxy = "proxy"
+)
+
+var (
+	accessDeniedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_access_denied_total",
+		Help: "The total number of connections dropped by the access lists per listener and reason",
+	}, []string{"listener", "reason"})
+)
+
+// errAccessDenied is returned by serve for connections that are dropped by the access lists
+var errAccessDenied = errors.New("access denied")
+
+// AccessConfig holds the global access lists. Allow and Deny contain IPs or CIDRs, when Allow is not
+// empty only the addresses in it can connect. Deny always takes precedence over Allow. The lists in File
+// are added to those in the config, the file is reloaded whenever it changes. IP bans are persisted to
+// BanFile.
+type AccessConfig struct {
+	Allow   []string `yaml:"allow"`
+	Deny    []string `yaml:"deny"`
+	File    string   `yaml:"file"`
+	BanFile string   `yaml:"banFile"`
+}
+
+// accessLists is the format of AccessConfig.File.
+type accessLists struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// IPBan bans an IP or CIDR until Expires, bans without Expires are permanent.
+type IPBan struct {
+	Address string     `json:"address"`
+	Reason  string     `json:"reason,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	network *net.IPNet
+}
+
+func (ban IPBan) expired(now time.Time) bool {
+	return ban.Expires != nil && now.After(*ban.Expires)
+}
+
+// ipNetList is a parsed list of IPs and CIDRs.
+type ipNetList []*net.IPNet
+
+// parseIPNet parses an IP or CIDR, a single IP is returned as a /32 or /128 network.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP or CIDR %s", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parseIPNetList(entries []string) (ipNetList, error) {
+	list := make(ipNetList, 0, len(entries))
+	for _, entry := range entries {
+		network, err := parseIPNet(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (list ipNetList) contains(ip net.IP) bool {
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess returns the reason ip is rejected by the allow and deny lists, or an empty string if it
+// is allowed.
+func checkAccess(allow, deny ipNetList, ip net.IP) string {
+	if deny.contains(ip) {
+		return AccessDenied
+	}
+	if len(allow) > 0 && !allow.contains(ip) {
+		return AccessNotAllowed
+	}
+	return ""
+}
+
+// accessControl holds the parsed global access lists and the IP bans of the gateway.
+type accessControl struct {
+	mu      sync.RWMutex
+	allow   ipNetList
+	deny    ipNetList
+	bans    map[string]IPBan
+	banFile string
+	// saveMu serializes writes to the ban file
+	saveMu sync.Mutex
+}
+
+// LoadAccessLists parses the global access lists of the global config and its access file. The previous
+// lists are kept if one of them is invalid.
+func (gateway *Gateway) LoadAccessLists() error {
+	cfg := GammaConfig().Access
+	allowEntries, denyEntries := cfg.Allow, cfg.Deny
+	if cfg.File != "" {
+		bb, err := ioutil.ReadFile(cfg.File)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var lists accessLists
+		if err := yaml.Unmarshal(bb, &lists); err != nil {
+			return fmt.Errorf("parse %s: %w", cfg.File, err)
+		}
+		allowEntries = append(append([]string{}, allowEntries...), lists.Allow...)
+		denyEntries = append(append([]string{}, denyEntries...), lists.Deny...)
+	}
+
+	allow, err := parseIPNetList(allowEntries)
+	if err != nil {
+		return fmt.Errorf("invalid allow list: %w", err)
+	}
+	deny, err := parseIPNetList(denyEntries)
+	if err != nil {
+		return fmt.Errorf("invalid deny list: %w", err)
+	}
+
+	gateway.access.mu.Lock()
+	gateway.access.allow, gateway.access.deny = allow, deny
+	gateway.access.mu.Unlock()
+	return nil
+}
+
+// LoadIPBans loads the IP bans from path, bans added later are persisted to it. A missing file is not
+// an error.
+func (gateway *Gateway) LoadIPBans(path string) error {
+	bans := map[string]IPBan{}
+	bb, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bb) > 0 {
+		var list []IPBan
+		if err := json.Unmarshal(bb, &list); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		now := time.Now()
+		for _, ban := range list {
+			if ban.network, err = parseIPNet(ban.Address); err != nil {
+				return fmt.Errorf("parse %s: %w", path, err)
+			}
+			if !ban.expired(now) {
+				bans[ban.network.String()] = ban
+			}
+		}
+	}
+
+	gateway.access.mu.Lock()
+	gateway.access.bans = bans
+	gateway.access.banFile = path
+	gateway.access.mu.Unlock()
+	return nil
+}
+
+// IPBans returns the IP bans that did not expire yet, sorted by address.
+func (gateway *Gateway) IPBans() []IPBan {
+	gateway.access.mu.RLock()
+	defer gateway.access.mu.RUnlock()
+
+	now := time.Now()
+	bans := make([]IPBan, 0, len(gateway.access.bans))
+	for _, ban := range gateway.access.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Address < bans[j].Address
+	})
+	return bans
+}
+
+// BanIP bans the IP or CIDR address for duration, a duration of 0 bans it permanently. Players that are
+// connected from the address are kicked.
+func (gateway *Gateway) BanIP(address, reason string, duration time.Duration) (IPBan, error) {
+	network, err := parseIPNet(address)
+	if err != nil {
+		return IPBan{}, err
+	}
+	ban := IPBan{Address: network.String(), Reason: reason, network: network}
+	if duration > 0 {
+		expires := time.Now().Add(duration)
+		ban.Expires = &expires
+	}
+
+	gateway.access.mu.Lock()
+	if gateway.access.bans == nil {
+		gateway.access.bans = map[string]IPBan{}
+	}
+	gateway.access.bans[ban.Address] = ban
+	gateway.access.mu.Unlock()
+
+	gateway.kick(func(session *Session) bool {
+		ip := net.ParseIP(session.ClientIP)
+		return ip != nil && network.Contains(ip)
+	}, reason)
+	return ban, gateway.saveIPBans()
+}
+
+// UnbanIP removes the ban of the IP or CIDR address, it returns false if the address wasn't banned.
+func (gateway *Gateway) UnbanIP(address string) (bool, error) {
+	network, err := parseIPNet(address)
+	if err != nil {
+		return false, err
+	}
+
+	gateway.access.mu.Lock()
+	_, ok := gateway.access.bans[network.String()]
+	delete(gateway.access.bans, network.String())
+	gateway.access.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, gateway.saveIPBans()
+}
+
+// saveIPBans writes the bans that did not expire yet to the ban file, if there is one.
+func (gateway *Gateway) saveIPBans() error {
+	gateway.access.mu.RLock()
+	path := gateway.access.banFile
+	gateway.access.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+
+	gateway.access.saveMu.Lock()
+	defer gateway.access.saveMu.Unlock()
+	bb, err := json.MarshalIndent(gateway.IPBans(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bb)
+}
+
+// checkIP returns the reason ip is rejected by the global access lists or the IP bans, or an empty
+// string if it may connect.
+func (gateway *Gateway) checkIP(ip net.IP) string {
+	gateway.access.mu.RLock()
+	defer gateway.access.mu.RUnlock()
+
+	if reason := checkAccess(gateway.access.allow, gateway.access.deny, ip); reason != "" {
+		return reason
+	}
+	now := time.Now()
+	for _, ban := range gateway.access.bans {
+		if ban.network.Contains(ip) && !ban.expired(now) {
+			return AccessBanned
+		}
+	}
+	return ""
+}
+
+// admit reports whether the client with the address addr may connect to the listener. Rejected
+// connections are counted and should be dropped without a response.
+func (gateway *Gateway) admit(addr net.Addr, listener string) bool {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return true
+	}
+
+	reason := gateway.checkIP(ip)
+	if reason == "" {
+		return true
+	}
+	accessDeniedCount.With(prometheus.Labels{"listener": listener, "reason": reason}).Inc()
+	if GammaConfig().Debug {
+		log.Printf("[!] Dropped %s on listener %s; reason: %s", addr, listener, reason)
+	}
+	return false
+}
+
+// parseAccessLists parses the access lists of the proxy config. If one of them is invalid every player is
+// rejected until the config is fixed.
+func (proxy *Proxy) parseAccessLists() error {
+	proxy.Config.RLock()
+	allowEntries, denyEntries := proxy.Config.Allow, proxy.Config.Deny
+	proxy.Config.RUnlock()
+
+	allow, err := parseIPNetList(allowEntries)
+	if err != nil {
+		err = fmt.Errorf("invalid allow list: %w", err)
+	}
+	deny, denyErr := parseIPNetList(denyEntries)
+	if denyErr != nil && err == nil {
+		err = fmt.Errorf("invalid deny list: %w", denyErr)
+	}
+
+	proxy.accessMu.Lock()
+	proxy.allow, proxy.deny, proxy.accessErr = allow, deny, err
+	proxy.accessMu.Unlock()
+	return err
+}
+
+// AllowsIP reports whether the access lists of the proxy allow ip to join.
+func (proxy *Proxy) AllowsIP(ip net.IP) bool {
+	proxy.accessMu.RLock()
+	defer proxy.accessMu.RUnlock()
+	if proxy.accessErr != nil {
+		return false
+	}
+	return checkAccess(proxy.allow, proxy.deny, ip) == ""
+}
@@ -0,0 +1,521 @@
+package gamma
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAPIBodySize limits the size of request bodies accepted by the API
+const maxAPIBodySize = 1 << 20
+
+var proxyNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type apiResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// kickRequest selects the sessions to kick, at least one selector has to be set.
+type kickRequest struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Proxy    string `json:"proxy"`
+	IP       string `json:"ip"`
+	Message  string `json:"message"`
+}
+
+// ipBanRequest bans an IP or CIDR for Duration milliseconds, or permanently if Duration is 0.
+type ipBanRequest struct {
+	Address  string `json:"address"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"`
+}
+
+// maintenanceRequest toggles the maintenance mode of a proxy, the message is kept if left empty.
+type maintenanceRequest struct {
+	Maintenance        bool   `json:"maintenance"`
+	MaintenanceMessage string `json:"maintenanceMessage"`
+}
+
+type backendResponse struct {
+	Address  string `json:"address"`
+	Weight   int    `json:"weight"`
+	Sessions int    `json:"sessions"`
+	Healthy  bool   `json:"healthy"`
+	Fallback bool   `json:"fallback"`
+}
+
+// EnableAPI serves the management API as configured by cfg.
+func (gateway *Gateway) EnableAPI(cfg ApiConfig) error {
+	if len(cfg.Tokens) == 0 && !cfg.Insecure && !isLoopbackBind(cfg.Bind) {
+		return fmt.Errorf("refusing to serve the API on %s without tokens; configure api.tokens, bind it to a loopback address or set api.insecure", cfg.Bind)
+	}
+	tlsConfig, err := loadAPITLS(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: cfg.Bind, Handler: gateway.apiHandler(), TLSConfig: tlsConfig}
+
+	ln, err := net.Listen("tcp", cfg.Bind)
+	if err != nil {
+		return err
+	}
+
+	gateway.mu.Lock()
+	gateway.apiServer = server
+	gateway.mu.Unlock()
+
+	gateway.wg.Add(1)
+	go func() {
+		defer gateway.wg.Done()
+
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("API endpoint stopped; error:", err)
+		}
+	}()
+
+	if len(cfg.Tokens) == 0 {
+		log.Println("No API tokens configured; the API is not authenticated")
+	}
+	log.Println("Enabling API endpoint on", cfg.Bind)
+	return nil
+}
+
+func (gateway *Gateway) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", gateway.handleRoot)
+	mux.HandleFunc("/proxies", gateway.handleProxies)
+	mux.HandleFunc("/proxies/", gateway.handleProxy)
+	mux.HandleFunc("/players", gateway.handlePlayers)
+	mux.HandleFunc("/players/kick", gateway.handleKick)
+	mux.HandleFunc("/events", gateway.handleEvents)
+	mux.HandleFunc("/bans/ips", gateway.handleIPBans)
+	gateway.registerStatusRoutes(mux)
+	return authenticate(mux)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed writing API response; error:", err)
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiResponse{Success: status < 400, Message: message})
+}
+
+func (gateway *Gateway) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleProxies serves GET /proxies.
+func (gateway *Gateway) handleProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, gateway.ProxyNames())
+}
+
+// handleProxy serves /proxies/{name} and its sub resources.
+func (gateway *Gateway) handleProxy(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/proxies/"), "/")
+	name := parts[0]
+	if !proxyNamePattern.MatchString(name) {
+		writeResponse(w, http.StatusBadRequest, "invalid proxy name")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "backends" {
+		gateway.handleProxyBackends(w, r, name)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "maintenance" {
+		gateway.handleProxyMaintenance(w, r, name)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "players" {
+		gateway.handleProxyPlayers(w, r, name)
+		return
+	}
+	if len(parts) > 1 {
+		writeResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		proxy, ok := gateway.ProxyByName(name)
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "proxy not found")
+			return
+		}
+		// The config is marshalled before writing, a slow client must not hold the lock of the config
+		proxy.Config.RLock()
+		bb, err := json.Marshal(proxy.Config)
+		proxy.Config.RUnlock()
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, json.RawMessage(bb))
+	case http.MethodPost, http.MethodPut:
+		gateway.handlePutProxy(w, r, name)
+	case http.MethodDelete:
+		ok, err := gateway.DeleteProxy(name)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "proxy not found")
+			return
+		}
+		writeResponse(w, http.StatusOK, "the proxy has been successfully removed")
+	default:
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handlePutProxy creates the proxy name or replaces its config.
+func (gateway *Gateway) handlePutProxy(w http.ResponseWriter, r *http.Request, name string) {
+	bb, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cfg, err := NewProxyConfig(bb)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid proxy config: %s", err))
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := gateway.checkConflicts(name, cfg); err != nil {
+		writeResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	created, err := gateway.PutProxy(name, cfg)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !created {
+		writeResponse(w, http.StatusOK, "the proxy has been successfully updated")
+		return
+	}
+	writeResponse(w, http.StatusCreated, "the proxy has been successfully added")
+}
+
+// handleProxyMaintenance serves POST /proxies/{name}/maintenance.
+func (gateway *Gateway) handleProxyMaintenance(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	proxy, ok := gateway.ProxyByName(name)
+	if !ok {
+		writeResponse(w, http.StatusNotFound, "proxy not found")
+		return
+	}
+
+	var req maintenanceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize)).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid maintenance request: %s", err))
+		return
+	}
+
+	proxy.Config.RLock()
+	bb, err := json.Marshal(proxy.Config)
+	proxy.Config.RUnlock()
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg, err := NewProxyConfig(bb)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.Maintenance = req.Maintenance
+	if req.MaintenanceMessage != "" {
+		cfg.MaintenanceMessage = req.MaintenanceMessage
+	}
+
+	if _, err := gateway.PutProxy(name, cfg); err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Maintenance {
+		writeResponse(w, http.StatusOK, "maintenance has been enabled")
+		return
+	}
+	writeResponse(w, http.StatusOK, "maintenance has been disabled")
+}
+
+// handleProxyBackends serves GET /proxies/{name}/backends.
+func (gateway *Gateway) handleProxyBackends(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	proxy, ok := gateway.ProxyByName(name)
+	if !ok {
+		writeResponse(w, http.StatusNotFound, "proxy not found")
+		return
+	}
+
+	resp := []backendResponse{}
+	for _, backend := range proxy.Backends() {
+		resp = append(resp, backendResponse{
+			Address:  backend.Address,
+			Weight:   backend.Weight,
+			Sessions: backend.Sessions(),
+			Healthy:  backend.Healthy(),
+		})
+	}
+	for _, backend := range proxy.Fallbacks() {
+		resp = append(resp, backendResponse{
+			Address:  backend.Address,
+			Weight:   backend.Weight,
+			Sessions: backend.Sessions(),
+			Healthy:  backend.Healthy(),
+			Fallback: true,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePlayers serves GET /players.
+func (gateway *Gateway) handlePlayers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, gateway.Sessions())
+}
+
+// handleKick serves POST /players/kick.
+func (gateway *Gateway) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req kickRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize)).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid kick request: %s", err))
+		return
+	}
+
+	n := 0
+	switch {
+	case req.ID != "":
+		if gateway.KickSession(req.ID, req.Message) {
+			n = 1
+		}
+	case req.Username != "":
+		n = gateway.KickPlayer(req.Username, req.Message)
+	case req.Proxy != "":
+		n = gateway.KickProxy(req.Proxy, req.Message)
+	case req.IP != "":
+		n = gateway.KickIP(req.IP, req.Message)
+	default:
+		writeResponse(w, http.StatusBadRequest, "one of id, username, proxy or ip is required")
+		return
+	}
+
+	if n == 0 {
+		writeResponse(w, http.StatusNotFound, "no matching players")
+		return
+	}
+	writeResponse(w, http.StatusOK, fmt.Sprintf("kicked %d players", n))
+}
+
+// handleIPBans serves GET, POST and DELETE /bans/ips. DELETE takes the address as query parameter.
+func (gateway *Gateway) handleIPBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, gateway.IPBans())
+	case http.MethodPost:
+		var req ipBanRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid ban request: %s", err))
+			return
+		}
+		if req.Duration < 0 {
+			writeResponse(w, http.StatusBadRequest, "duration must not be negative")
+			return
+		}
+		if _, err := parseIPNet(req.Address); err != nil {
+			writeResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ban, err := gateway.BanIP(req.Address, req.Reason, time.Duration(req.Duration)*time.Millisecond)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("the ban is active but could not be saved: %s", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, ban)
+	case http.MethodDelete:
+		ok, err := gateway.UnbanIP(r.URL.Query().Get("address"))
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "the address is not banned")
+			return
+		}
+		writeResponse(w, http.StatusOK, "the ban has been removed")
+	default:
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleEvents serves GET /events as a stream of server-sent events. The stream can be filtered with the
+// query parameters proxy and type, both accept comma separated lists.
+func (gateway *Gateway) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponse(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	proxies := queryList(r, "proxy")
+	types := queryList(r, "type")
+
+	events, unsubscribe := gateway.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	done := gateway.doneChan()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if len(proxies) > 0 && !proxies[event.Proxy] {
+				continue
+			}
+			if len(types) > 0 && !types[string(event.Type)] {
+				continue
+			}
+			bb, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, bb); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// queryList returns the comma separated values of the query parameter key as a set.
+func queryList(r *http.Request, key string) map[string]bool {
+	values := map[string]bool{}
+	for _, param := range r.URL.Query()[key] {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values[value] = true
+			}
+		}
+	}
+	return values
+}
+
+// handleProxyPlayers serves GET /proxies/{name}/players.
+func (gateway *Gateway) handleProxyPlayers(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, ok := gateway.ProxyByName(name); !ok {
+		writeResponse(w, http.StatusNotFound, "proxy not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, gateway.ProxySessions(name))
+}
+
+// checkConflicts returns an error if a domain of cfg is already used by another proxy on the same listener.
+func (gateway *Gateway) checkConflicts(name string, cfg *ProxyConfig) error {
+	for _, uid := range NewProxy(name, cfg).UIDs() {
+		v, ok := gateway.Proxies.Load(uid)
+		if ok && v.(*Proxy).UID != name {
+			return errors.New("domain is already used by proxy " + v.(*Proxy).UID)
+		}
+	}
+	return nil
+}
+
+// ProxyByName returns the registered proxy with the name.
+func (gateway *Gateway) ProxyByName(name string) (*Proxy, bool) {
+	var proxy *Proxy
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		if v.(*Proxy).UID == name {
+			proxy = v.(*Proxy)
+			return false
+		}
+		return true
+	})
+	return proxy, proxy != nil
+}
+
+// ProxyNames returns the names of all registered proxies in lexical order.
+func (gateway *Gateway) ProxyNames() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		name := v.(*Proxy).UID
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
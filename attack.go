@@ -0,0 +1,206 @@
+package gamma
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeTimeout is the time a client has to complete the login outside of under-attack mode
+const handshakeTimeout = 5 * time.Second
+
+var (
+	underAttackGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gamma_under_attack",
+		Help: "1 while the gateway is in under-attack mode, 0 if not",
+	})
+)
+
+// AttackModeConfig configures the automatic under-attack mode. The gateway enters it when the new
+// connections or the failed handshakes per second reach their threshold, and leaves it once both stayed
+// below their cool-down level for CoolDown milliseconds. A cool-down level of 0 uses the threshold.
+type AttackModeConfig struct {
+	Enabled                  bool    `yaml:"enabled"`
+	ConnectionThreshold      float64 `yaml:"connectionThreshold"`
+	FailedHandshakeThreshold float64 `yaml:"failedHandshakeThreshold"`
+	ConnectionCoolDown       float64 `yaml:"connectionCoolDown"`
+	FailedHandshakeCoolDown  float64 `yaml:"failedHandshakeCoolDown"`
+	CoolDown                 int     `yaml:"coolDown"`
+	// HandshakeTimeout replaces the default 5 second handshake deadline while under attack
+	HandshakeTimeout int `yaml:"handshakeTimeout"`
+	// IP replaces the per IP rate limit while under attack
+	IP RateLimit `yaml:"ip"`
+	// KnownIPTTL is how long an IP is allowed to connect while under attack after it completed a login
+	KnownIPTTL int `yaml:"knownIpTtl"`
+}
+
+// attackMonitor measures the connection and failed handshake rates of the gateway and remembers the
+// IPs that recently completed a login.
+type attackMonitor struct {
+	connections      int64
+	failedHandshakes int64
+	active           int32
+	calmSince        time.Time
+
+	mu       sync.Mutex
+	knownIPs map[string]time.Time
+}
+
+// UnderAttack reports whether the gateway is in under-attack mode.
+func (gateway *Gateway) UnderAttack() bool {
+	return atomic.LoadInt32(&gateway.underAttack.active) == 1
+}
+
+func (m *attackMonitor) connection() {
+	atomic.AddInt64(&m.connections, 1)
+}
+
+func (m *attackMonitor) failedHandshake() {
+	atomic.AddInt64(&m.failedHandshakes, 1)
+}
+
+// rememberIP marks ip as a known IP that may connect while under attack.
+func (m *attackMonitor) rememberIP(ip string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.knownIPs == nil {
+		m.knownIPs = map[string]time.Time{}
+	}
+	m.knownIPs[ip] = time.Now()
+}
+
+func (m *attackMonitor) knownIP(ip string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen, ok := m.knownIPs[ip]
+	return ok && time.Since(seen) < ttl
+}
+
+func (m *attackMonitor) forgetIPs(ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ip, seen := range m.knownIPs {
+		if time.Since(seen) >= ttl {
+			delete(m.knownIPs, ip)
+		}
+	}
+}
+
+// handshakeTimeout returns the deadline of new connections for the current mode.
+func (gateway *Gateway) handshakeTimeout() time.Duration {
+	cfg := GammaConfig().AttackMode
+	if gateway.UnderAttack() && cfg.HandshakeTimeout > 0 {
+		return time.Duration(cfg.HandshakeTimeout) * time.Millisecond
+	}
+	return handshakeTimeout
+}
+
+// rateLimitConfig returns the rate limits for the current mode, the per IP limit is replaced by the
+// stricter one of the attack mode while under attack.
+func (gateway *Gateway) rateLimitConfig() RateLimitConfig {
+	cfg := GammaConfig()
+	limits := cfg.RateLimit
+	if gateway.UnderAttack() && cfg.AttackMode.IP.Rate > 0 {
+		if !limits.Enabled {
+			limits = RateLimitConfig{Enabled: true}
+		}
+		limits.IP = cfg.AttackMode.IP
+	}
+	return limits
+}
+
+// allowUnknown reports whether a connection from addr is accepted in the current mode. Only IPs that
+// recently completed a login are accepted while under attack.
+func (gateway *Gateway) allowUnknown(addr net.Addr) bool {
+	if !gateway.UnderAttack() {
+		return true
+	}
+	ttl := time.Duration(GammaConfig().AttackMode.KnownIPTTL) * time.Millisecond
+	return gateway.underAttack.knownIP(clientIP(addr), ttl)
+}
+
+// monitorAttacks checks the connection and failed handshake rates every second and switches the
+// under-attack mode on or off.
+func (gateway *Gateway) monitorAttacks() {
+	done := gateway.doneChan()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+			connections := float64(atomic.SwapInt64(&gateway.underAttack.connections, 0)) / elapsed
+			failed := float64(atomic.SwapInt64(&gateway.underAttack.failedHandshakes, 0)) / elapsed
+
+			cfg := GammaConfig().AttackMode
+			gateway.underAttack.forgetIPs(time.Duration(cfg.KnownIPTTL) * time.Millisecond)
+			gateway.updateAttackMode(cfg, now, connections, failed)
+		}
+	}
+}
+
+func (gateway *Gateway) updateAttackMode(cfg AttackModeConfig, now time.Time, connections, failed float64) {
+	m := &gateway.underAttack
+	if !gateway.UnderAttack() {
+		if !cfg.Enabled {
+			return
+		}
+		if (cfg.ConnectionThreshold > 0 && connections >= cfg.ConnectionThreshold) ||
+			(cfg.FailedHandshakeThreshold > 0 && failed >= cfg.FailedHandshakeThreshold) {
+			gateway.setUnderAttack(true, "%.1f connections/s and %.1f failed handshakes/s", connections, failed)
+		}
+		return
+	}
+
+	if !cfg.Enabled {
+		gateway.setUnderAttack(false, "attack mode disabled")
+		return
+	}
+	connectionCoolDown, failedCoolDown := cfg.ConnectionCoolDown, cfg.FailedHandshakeCoolDown
+	if connectionCoolDown <= 0 {
+		connectionCoolDown = cfg.ConnectionThreshold
+	}
+	if failedCoolDown <= 0 {
+		failedCoolDown = cfg.FailedHandshakeThreshold
+	}
+	if (connectionCoolDown > 0 && connections >= connectionCoolDown) || (failedCoolDown > 0 && failed >= failedCoolDown) {
+		m.calmSince = time.Time{}
+		return
+	}
+	if m.calmSince.IsZero() {
+		m.calmSince = now
+	}
+	if now.Sub(m.calmSince) >= time.Duration(cfg.CoolDown)*time.Millisecond {
+		gateway.setUnderAttack(false, "%.1f connections/s and %.1f failed handshakes/s", connections, failed)
+	}
+}
+
+func (gateway *Gateway) setUnderAttack(active bool, format string, args ...interface{}) {
+	var v int32
+	eventType := EventAttackEnded
+	if active {
+		v = 1
+		eventType = EventUnderAttack
+	}
+	atomic.StoreInt32(&gateway.underAttack.active, v)
+	gateway.underAttack.calmSince = time.Time{}
+	underAttackGauge.Set(float64(v))
+
+	message := fmt.Sprintf(format, args...)
+	if active {
+		log.Println("Entering under-attack mode;", message)
+	} else {
+		log.Println("Leaving under-attack mode;", message)
+	}
+	gateway.Publish(Event{Type: eventType, Message: message})
+}
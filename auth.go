@@ -0,0 +1,192 @@
+package gamma
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ScopeRead grants access to all GET routes
+	ScopeRead = "read"
+	// ScopeProxyWrite grants creating, updating and deleting proxies
+	ScopeProxyWrite = "proxy-write"
+	// ScopePlayerAdmin grants managing connected players and bans
+	ScopePlayerAdmin = "player-admin"
+)
+
+var (
+	apiRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_api_rejected_total",
+		Help: "The total number of rejected API requests by reason",
+	}, []string{"reason"})
+)
+
+// publicPaths are the routes that can be requested without a token.
+var publicPaths = map[string]bool{
+	"/":        true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// loadAPITLS returns the TLS config of the API or nil if TLS is disabled.
+func loadAPITLS(cfg ApiTLS) (*tls.Config, error) {
+	if cfg.Cert == "" && cfg.Key == "" {
+		if cfg.ClientCA != "" {
+			return nil, errors.New("api clientCA requires tls cert and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCA != "" {
+		bb, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bb) {
+			return nil, errors.New("no certificates found in " + cfg.ClientCA)
+		}
+		// The client certificate is verified in VerifyConnection instead of by crypto/tls, so that rejected
+		// handshakes are counted like rejected requests
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyClientCert(cs, pool)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyClientCert checks that the client sent a certificate for client authentication that is signed
+// by a CA in pool.
+func verifyClientCert(cs tls.ConnectionState, pool *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		apiRejectedCount.With(prometheus.Labels{"reason": "missing_client_cert"}).Inc()
+		return errors.New("client certificate required")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		apiRejectedCount.With(prometheus.Labels{"reason": "invalid_client_cert"}).Inc()
+		return err
+	}
+	return nil
+}
+
+// isLoopbackBind reports whether the bind address only accepts connections from the local machine.
+func isLoopbackBind(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// openAPIAllowed reports whether the request may be served without a token. This is only the case when
+// no tokens are configured and the API was reached on a loopback address or is explicitly insecure.
+func openAPIAllowed(r *http.Request) bool {
+	if GammaConfig().Api.Insecure {
+		return true
+	}
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requiredScope returns the scope a token needs for the request.
+func requiredScope(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ScopeRead
+	}
+	if strings.HasPrefix(r.URL.Path, "/players") || strings.Contains(r.URL.Path, "/players/") ||
+		strings.HasPrefix(r.URL.Path, "/bans/") {
+		return ScopePlayerAdmin
+	}
+	return ScopeProxyWrite
+}
+
+// authenticate rejects requests without a bearer token that has the scope required for the route.
+// Tokens are read from the global config on every request, so they can be changed by reloading it.
+// Without tokens the API is only open on loopback addresses or when it is explicitly insecure, the root
+// and the health probes are always public.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens := GammaConfig().Api.Tokens
+		if publicPaths[r.URL.Path] || (len(tokens) == 0 && openAPIAllowed(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(tokens) == 0 {
+			apiRejectedCount.With(prometheus.Labels{"reason": "no_tokens"}).Inc()
+			writeResponse(w, http.StatusUnauthorized, "no api tokens configured")
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			apiRejectedCount.With(prometheus.Labels{"reason": "missing_token"}).Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+		var matched *ApiToken
+		for i := range tokens {
+			if tokens[i].Token != "" && subtle.ConstantTimeCompare(token, []byte(tokens[i].Token)) == 1 {
+				matched = &tokens[i]
+				break
+			}
+		}
+		if matched == nil {
+			apiRejectedCount.With(prometheus.Labels{"reason": "invalid_token"}).Inc()
+			writeResponse(w, http.StatusUnauthorized, "invalid bearer token")
+			return
+		}
+
+		scope := requiredScope(r)
+		for _, s := range matched.Scopes {
+			if s == scope {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		apiRejectedCount.With(prometheus.Labels{"reason": "forbidden"}).Inc()
+		writeResponse(w, http.StatusForbidden, "token lacks scope "+scope)
+	})
+}
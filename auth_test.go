@@ -0,0 +1,107 @@
+package gamma
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setGammaConfig makes cfg the global config for the duration of the test.
+func setGammaConfig(t *testing.T, cfg GlobalConfig) {
+	t.Helper()
+	previous := GammaConfig()
+	globalConfig.Store(&cfg)
+	t.Cleanup(func() {
+		globalConfig.Store(previous)
+	})
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/proxies", ScopeRead},
+		{http.MethodHead, "/players", ScopeRead},
+		{http.MethodGet, "/bans/ips", ScopeRead},
+		{http.MethodPost, "/players/kick", ScopePlayerAdmin},
+		{http.MethodPost, "/bans/ips", ScopePlayerAdmin},
+		{http.MethodDelete, "/bans/ips/192.0.2.1", ScopePlayerAdmin},
+		{http.MethodPost, "/proxies/lobby/players/kick", ScopePlayerAdmin},
+		{http.MethodPost, "/proxies/lobby/maintenance", ScopeProxyWrite},
+		{http.MethodPut, "/proxies/lobby", ScopeProxyWrite},
+		{http.MethodDelete, "/proxies/lobby", ScopeProxyWrite},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			if got := requiredScope(httptest.NewRequest(test.method, test.path, nil)); got != test.want {
+				t.Errorf("got scope %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tokens := []ApiToken{
+		{Token: "reader", Scopes: []string{ScopeRead}},
+		{Token: "writer", Scopes: []string{ScopeRead, ScopeProxyWrite}},
+		{Token: "admin", Scopes: []string{ScopePlayerAdmin}},
+	}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	public := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+
+	tests := []struct {
+		name   string
+		tokens []ApiToken
+		// localAddr is the address the request was received on
+		localAddr net.Addr
+		method    string
+		path      string
+		token     string
+		want      int
+	}{
+		{"public root", tokens, public, http.MethodGet, "/", "", http.StatusOK},
+		{"public health probe", tokens, public, http.MethodGet, "/healthz", "", http.StatusOK},
+		{"public readiness probe", nil, public, http.MethodGet, "/readyz", "", http.StatusOK},
+		{"missing token", tokens, public, http.MethodGet, "/proxies", "", http.StatusUnauthorized},
+		{"invalid token", tokens, public, http.MethodGet, "/proxies", "unknown", http.StatusUnauthorized},
+		{"token with scope", tokens, public, http.MethodGet, "/proxies", "reader", http.StatusOK},
+		{"token without scope", tokens, public, http.MethodPut, "/proxies/lobby", "reader", http.StatusForbidden},
+		{"kick requires player-admin", tokens, public, http.MethodPost, "/players/kick", "writer", http.StatusForbidden},
+		{"kick with player-admin", tokens, public, http.MethodPost, "/players/kick", "admin", http.StatusOK},
+		{"ban requires player-admin", tokens, public, http.MethodPost, "/bans/ips", "writer", http.StatusForbidden},
+		{"ban with player-admin", tokens, public, http.MethodPost, "/bans/ips", "admin", http.StatusOK},
+		{"maintenance requires proxy-write", tokens, public, http.MethodPost, "/proxies/lobby/maintenance", "admin", http.StatusForbidden},
+		{"maintenance with proxy-write", tokens, public, http.MethodPost, "/proxies/lobby/maintenance", "writer", http.StatusOK},
+		{"no tokens on loopback", nil, loopback, http.MethodPut, "/proxies/lobby", "", http.StatusOK},
+		{"no tokens on a public address", nil, public, http.MethodGet, "/proxies", "", http.StatusUnauthorized},
+		{"no tokens without a local address", nil, nil, http.MethodGet, "/proxies", "", http.StatusUnauthorized},
+		{"tokens on loopback", tokens, loopback, http.MethodGet, "/proxies", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig
+			cfg.Api.Tokens = test.tokens
+			setGammaConfig(t, cfg)
+
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.localAddr != nil {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, test.localAddr))
+			}
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("got status %v, want %v", w.Code, test.want)
+			}
+		})
+	}
+}
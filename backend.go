@@ -0,0 +1,215 @@
+package gamma
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"math/rand"
+	"sync/atomic"
+)
+
+var (
+	fallbackCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_fallbacks_total",
+		Help: "The total number of players sent to a fallback backend",
+	}, []string{"host", "backend"})
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+	BalanceWeighted         = "weighted"
+)
+
+var errNoBackend = errors.New("no backend available")
+
+// BackendConfig is a single backend server a proxy can forward players to.
+type BackendConfig struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+// Backend holds the runtime state of a backend server of a proxy.
+type Backend struct {
+	Address  string
+	Weight   int
+	sessions int32
+
+	// unhealthy is set to 1 once the health checks failed often enough
+	unhealthy int32
+	successes int
+	failures  int
+}
+
+// Sessions returns the number of players currently proxied to the backend.
+func (backend *Backend) Sessions() int {
+	return int(atomic.LoadInt32(&backend.sessions))
+}
+
+func (backend *Backend) addSession(delta int32) {
+	atomic.AddInt32(&backend.sessions, delta)
+}
+
+// Backends returns the backends of the proxy. They are rebuilt from the config when the proxy is
+// registered, the Address and Weight of a Backend never change after it was created.
+func (proxy *Proxy) Backends() []*Backend {
+	proxy.ensureBackends()
+	proxy.backendsMu.Lock()
+	defer proxy.backendsMu.Unlock()
+	return proxy.backends
+}
+
+// Fallbacks returns the fallback backends of the proxy in the order they should be tried.
+func (proxy *Proxy) Fallbacks() []*Backend {
+	proxy.ensureBackends()
+	proxy.backendsMu.Lock()
+	defer proxy.backendsMu.Unlock()
+	return proxy.fallbacks
+}
+
+// ensureBackends builds the backends of proxies that were never registered, e.g. when HandleLogin is
+// called directly.
+func (proxy *Proxy) ensureBackends() {
+	proxy.backendsMu.Lock()
+	synced := proxy.backendsSynced
+	proxy.backendsMu.Unlock()
+	if !synced {
+		proxy.syncBackends()
+	}
+}
+
+// syncBackends rebuilds the backends and fallbacks from the config of the proxy.
+func (proxy *Proxy) syncBackends() {
+	proxy.Config.RLock()
+	cfgs := proxy.Config.Backends
+	if len(cfgs) == 0 {
+		cfgs = []BackendConfig{{Address: proxy.Config.ProxyTo}}
+	}
+	fallbackCfgs := make([]BackendConfig, 0, len(proxy.Config.Fallbacks))
+	for _, addr := range proxy.Config.Fallbacks {
+		fallbackCfgs = append(fallbackCfgs, BackendConfig{Address: addr})
+	}
+	proxy.Config.RUnlock()
+
+	proxy.backendsMu.Lock()
+	defer proxy.backendsMu.Unlock()
+	proxy.backends = syncBackends(proxy.backends, cfgs)
+	proxy.fallbacks = syncBackends(proxy.fallbacks, fallbackCfgs)
+	proxy.backendsSynced = true
+}
+
+// syncBackends returns the backends for cfgs, reusing the existing backends with the same address and
+// weight so that their sessions and health are kept.
+func syncBackends(existing []*Backend, cfgs []BackendConfig) []*Backend {
+	byAddr := map[string]*Backend{}
+	for _, backend := range existing {
+		byAddr[backend.Address] = backend
+	}
+
+	backends := make([]*Backend, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		weight := cfg.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		backend, ok := byAddr[cfg.Address]
+		if !ok || backend.Weight != weight {
+			backend = &Backend{Address: cfg.Address, Weight: weight}
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+func (proxy *Proxy) Balancing() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.Balancing
+}
+
+// SelectBackend picks the backend the next player is sent to according to the balancing strategy of the
+// proxy.
+func (proxy *Proxy) SelectBackend() (*Backend, error) {
+	var backends []*Backend
+	for _, backend := range proxy.Backends() {
+		if backend.Healthy() {
+			backends = append(backends, backend)
+		}
+	}
+	return proxy.selectBackend(backends)
+}
+
+// dialBackend dials the backend selected by the balancing strategy and, if that fails, the fallbacks of
+// the proxy in order. The session of the returned backend is already counted. Capture groups of the
+// route are substituted into the backend addresses. Every attempt is bounded by the dial timeout.
+func (proxy *Proxy) dialBackend(dialer raknet.Dialer, route *route, session *Session) (*Backend, *raknet.Conn, error) {
+	var candidates []*Backend
+	if backend, err := proxy.SelectBackend(); err == nil {
+		candidates = append(candidates, backend)
+	} else {
+		log.Printf("[i] %s has no healthy backend", proxy.DomainName())
+	}
+	primaries := len(candidates)
+	candidates = append(candidates, proxy.Fallbacks()...)
+
+	err := errNoBackend
+	for i, backend := range candidates {
+		// Count the session right away so that concurrent logins see it when balancing
+		backend.addSession(1)
+		addr := route.expand(backend.Address)
+		rc, dialErr := dialer.DialTimeout(addr, proxy.Timeout())
+		if dialErr == nil {
+			if i >= primaries {
+				log.Printf("[i] %s is using fallback %s", proxy.DomainName(), addr)
+				fallbackCount.With(prometheus.Labels{"host": proxy.DomainName(), "backend": backend.Address}).Inc()
+			}
+			return backend, rc, nil
+		}
+		backend.addSession(-1)
+		log.Printf("[i] %s did not respond to ping; is the target offline?", addr)
+		event := session.event(EventDialFailed)
+		event.Backend = addr
+		event.Message = dialErr.Error()
+		proxy.events.publish(event)
+		err = dialErr
+	}
+	return nil, nil, err
+}
+
+func (proxy *Proxy) selectBackend(backends []*Backend) (*Backend, error) {
+	if len(backends) == 0 {
+		return nil, errNoBackend
+	}
+
+	switch proxy.Balancing() {
+	case BalanceLeastConnections:
+		selected := backends[0]
+		for _, backend := range backends[1:] {
+			if backend.Sessions() < selected.Sessions() {
+				selected = backend
+			}
+		}
+		return selected, nil
+	case BalanceRandom:
+		return backends[rand.Intn(len(backends))], nil
+	case BalanceWeighted:
+		total := 0
+		for _, backend := range backends {
+			total += backend.Weight
+		}
+		n := rand.Intn(total)
+		for _, backend := range backends {
+			n -= backend.Weight
+			if n < 0 {
+				return backend, nil
+			}
+		}
+		return backends[len(backends)-1], nil
+	default:
+		i := atomic.AddUint32(&proxy.roundRobin, 1) - 1
+		return backends[int(i)%len(backends)], nil
+	}
+}
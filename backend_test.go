@@ -0,0 +1,60 @@
+package gamma
+
+import (
+	"sync"
+	"testing"
+)
+
+func testProxy(t *testing.T, json string) *Proxy {
+	t.Helper()
+	cfg, err := NewProxyConfig([]byte(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxy("test", cfg)
+}
+
+func TestSelectBackendWeighted(t *testing.T) {
+	proxy := testProxy(t, `{"balancing":"weighted","backends":[{"address":"a:1","weight":1},{"address":"b:1","weight":0}]}`)
+	backends := proxy.Backends()
+	if len(backends) != 2 || backends[1].Weight != 1 {
+		t.Fatalf("got backends %+v, want two with weight 1", backends)
+	}
+
+	// Backends keep their state while address and weight stay the same
+	backends[0].addSession(1)
+	if err := proxy.Config.update(&ProxyConfig{Balancing: BalanceWeighted, Backends: []BackendConfig{{Address: "a:1", Weight: 1}, {Address: "b:1", Weight: 5}}}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.syncBackends()
+	synced := proxy.Backends()
+	if synced[0] != backends[0] || synced[0].Sessions() != 1 {
+		t.Error("unchanged backend was replaced")
+	}
+	if synced[1] == backends[1] || synced[1].Weight != 5 || backends[1].Weight != 1 {
+		t.Error("backend with a new weight was modified instead of replaced")
+	}
+}
+
+// TestSelectBackendConcurrent selects backends while the config is reloaded, run it with -race.
+func TestSelectBackendConcurrent(t *testing.T) {
+	proxy := testProxy(t, `{"balancing":"weighted","backends":[{"address":"a:1","weight":2},{"address":"b:1","weight":3}]}`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if _, err := proxy.SelectBackend(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		proxy.syncBackends()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,121 @@
+package gamma
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlayerBan bans the player with the XUID, UUID or username until Expires, bans without Expires are
+// permanent. At least one of the identifiers has to be set, usernames are matched case-insensitively.
+type PlayerBan struct {
+	XUID     string     `json:"xuid,omitempty"`
+	UUID     string     `json:"uuid,omitempty"`
+	Username string     `json:"username,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+func (ban PlayerBan) expired(now time.Time) bool {
+	return ban.Expires != nil && now.After(*ban.Expires)
+}
+
+// Message fills in the placeholders {username}, {reason} and {expires} of the ban message template.
+func (ban PlayerBan) Message(template, username string) string {
+	reason := ban.Reason
+	if reason == "" {
+		reason = "No reason given"
+	}
+	expires := "never"
+	if ban.Expires != nil {
+		expires = ban.Expires.UTC().Format("2006-01-02 15:04 MST")
+	}
+	return strings.NewReplacer(
+		"{username}", username,
+		"{reason}", reason,
+		"{expires}", expires,
+	).Replace(template)
+}
+
+// playerBans is the ban registry of the gateway, the bans are indexed by every identifier they have.
+type playerBans struct {
+	mu        sync.RWMutex
+	xuids     map[string]PlayerBan
+	uuids     map[string]PlayerBan
+	usernames map[string]PlayerBan
+}
+
+// LoadPlayerBans replaces the player bans with the bans in the json file at path and kicks the connected
+// players that are banned now. A missing file is not an error.
+func (gateway *Gateway) LoadPlayerBans(path string) error {
+	bb, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var bans []PlayerBan
+	if len(bb) > 0 {
+		if err := json.Unmarshal(bb, &bans); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	xuids, uuids, usernames := map[string]PlayerBan{}, map[string]PlayerBan{}, map[string]PlayerBan{}
+	for i, ban := range bans {
+		if ban.XUID == "" && ban.UUID == "" && ban.Username == "" {
+			return fmt.Errorf("parse %s: ban %d has no xuid, uuid or username", path, i)
+		}
+		if ban.XUID != "" {
+			xuids[ban.XUID] = ban
+		}
+		if ban.UUID != "" {
+			uuids[strings.ToLower(ban.UUID)] = ban
+		}
+		if ban.Username != "" {
+			usernames[strings.ToLower(ban.Username)] = ban
+		}
+	}
+
+	gateway.bans.mu.Lock()
+	gateway.bans.xuids, gateway.bans.uuids, gateway.bans.usernames = xuids, uuids, usernames
+	gateway.bans.mu.Unlock()
+	log.Printf("Loaded %d player bans from %s", len(bans), path)
+
+	gateway.sessions.Range(func(k, v interface{}) bool {
+		session := v.(*Session)
+		if ban, ok := gateway.PlayerBan(session.XUID, session.UUID, session.Username); ok {
+			log.Printf("[i] Kicking banned player %s (%s) from %s", session.Username, session.ClientIP, session.Proxy)
+			session.Kick(ban.Message(GammaConfig().BanMessage, session.Username))
+		}
+		return true
+	})
+	return nil
+}
+
+// PlayerBan returns the active ban of the player with the XUID, UUID or username, if there is one.
+func (gateway *Gateway) PlayerBan(xuid, uuid, username string) (PlayerBan, bool) {
+	gateway.bans.mu.RLock()
+	defer gateway.bans.mu.RUnlock()
+
+	now := time.Now()
+	for _, lookup := range []struct {
+		bans map[string]PlayerBan
+		key  string
+	}{
+		{gateway.bans.xuids, xuid},
+		{gateway.bans.uuids, strings.ToLower(uuid)},
+		{gateway.bans.usernames, strings.ToLower(username)},
+	} {
+		if lookup.key == "" {
+			continue
+		}
+		if ban, ok := lookup.bans[lookup.key]; ok && !ban.expired(now) {
+			return ban, true
+		}
+	}
+	return PlayerBan{}, false
+}
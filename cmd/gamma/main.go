@@ -3,20 +3,29 @@ package main
 import (
 	"flag"
 	"github.com/lhridder/gamma"
-	"github.com/sandertv/go-raknet"
 	"log"
-	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	envPrefix     = "INFRARED_"
-	envConfigPath = envPrefix + "CONFIG_PATH"
-	clfConfigPath = "config-path"
+	envPrefix           = "GAMMA_"
+	envConfigPath       = envPrefix + "CONFIG_PATH"
+	envGlobalConfigPath = envPrefix + "GLOBAL_CONFIG"
+	clfConfigPath       = "config-path"
+	clfGlobalConfigPath = "global-config"
+
+	// legacyEnvConfigPath is still honored for deployments that predate the GAMMA_ prefix
+	legacyEnvConfigPath = "INFRARED_CONFIG_PATH"
 )
 
-var configPath = "./configs"
+var (
+	configPath       = "./configs"
+	globalConfigPath = "config.yml"
+)
 
 func envString(name string, value string) string {
 	envString := os.Getenv(name)
@@ -28,11 +37,14 @@ func envString(name string, value string) string {
 }
 
 func initEnv() {
+	configPath = envString(legacyEnvConfigPath, configPath)
 	configPath = envString(envConfigPath, configPath)
+	globalConfigPath = envString(envGlobalConfigPath, globalConfigPath)
 }
 
 func initFlags() {
 	flag.StringVar(&configPath, clfConfigPath, configPath, "path of all proxy configs")
+	flag.StringVar(&globalConfigPath, clfGlobalConfigPath, globalConfigPath, "path of the global config file")
 	flag.Parse()
 }
 
@@ -44,14 +56,14 @@ func init() {
 func main() {
 	log.Println("Starting gamma")
 
-	err := gamma.LoadGlobalConfig()
+	err := gamma.LoadGlobalConfig(globalConfigPath)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	log.Println("Loading configs folder")
-	cfgs, err := gamma.LoadProxyConfigsFromPath("./configs")
+	cfgs, err := gamma.LoadProxyConfigsFromPath(configPath)
 	if err != nil {
 		log.Printf("Failed loading proxy configs, error: %s", err)
 		return
@@ -59,29 +71,60 @@ func main() {
 
 	var proxies []*gamma.Proxy
 	for _, cfg := range cfgs {
-		proxies = append(proxies, &gamma.Proxy{
-			Config: cfg,
-			Dialer: raknet.Dialer{
-				UpstreamDialer: &net.Dialer{
-					Timeout: 5 * time.Second,
-					LocalAddr: &net.UDPAddr{
-						IP: net.ParseIP(cfg.ProxyBind),
-					},
-				},
-			},
-		})
+		proxies = append(proxies, gamma.NewProxy(cfg.Name(), cfg))
 	}
 
 	outCfgs := make(chan *gamma.ProxyConfig)
 	go func() {
-		if err := gamma.WatchProxyConfigFolder("./configs", outCfgs); err != nil {
+		if err := gamma.WatchProxyConfigFolder(configPath, outCfgs); err != nil {
 			log.Println("Failed watching config folder; error:", err)
 			log.Println("SYSTEM FAILURE: CONFIG WATCHER FAILED")
 		}
 	}()
 
 	log.Println("Starting gateway")
-	gateway := gamma.Gateway{ReceiveProxyProtocol: gamma.GammaConfig.ReceiveProxyProtocol}
+	gateway := gamma.Gateway{
+		ReceiveProxyProtocol: gamma.GammaConfig().ReceiveProxyProtocol,
+		ConfigPath:           configPath,
+	}
+
+	if err := gateway.LoadAccessLists(); err != nil {
+		log.Println("Failed loading access lists; error:", err)
+		return
+	}
+	if banFile := gamma.GammaConfig().Access.BanFile; banFile != "" {
+		if err := gateway.LoadIPBans(banFile); err != nil {
+			log.Println("Failed loading IP bans; error:", err)
+			return
+		}
+		go func() {
+			err := gamma.WatchFile(banFile, func() {
+				if err := gateway.LoadIPBans(banFile); err != nil {
+					log.Printf("Failed reloading %s; error: %s", banFile, err)
+				}
+			})
+			if err != nil {
+				log.Printf("Failed watching %s; error: %s", banFile, err)
+			}
+		}()
+	}
+
+	if banFile := gamma.GammaConfig().PlayerBanFile; banFile != "" {
+		if err := gateway.LoadPlayerBans(banFile); err != nil {
+			log.Println("Failed loading player bans; error:", err)
+			return
+		}
+		go func() {
+			err := gamma.WatchFile(banFile, func() {
+				if err := gateway.LoadPlayerBans(banFile); err != nil {
+					log.Printf("Failed reloading %s; error: %s", banFile, err)
+				}
+			})
+			if err != nil {
+				log.Printf("Failed watching %s; error: %s", banFile, err)
+			}
+		}()
+	}
 
 	go func() {
 		for {
@@ -90,23 +133,22 @@ func main() {
 				return
 			}
 
-			proxy := &gamma.Proxy{
-				Config: cfg,
-				UID:    cfg.Domains[0],
-				Dialer: raknet.Dialer{
-					UpstreamDialer: &net.Dialer{
-						Timeout: 5 * time.Second,
-					},
-				},
-			}
-			if err := gateway.RegisterProxy(proxy); err != nil {
+			if err := gateway.RegisterProxyConfig(cfg); err != nil {
 				log.Println("Failed registering proxy; error:", err)
 			}
 		}
 	}()
 
-	if gamma.GammaConfig.Prometheus.Enabled {
-		err := gateway.EnablePrometheus(gamma.GammaConfig.Prometheus.Bind)
+	if gamma.GammaConfig().Api.Enabled {
+		err := gateway.EnableAPI(gamma.GammaConfig().Api)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if gamma.GammaConfig().Prometheus.Enabled {
+		err := gateway.EnablePrometheus(gamma.GammaConfig().Prometheus.Bind)
 		if err != nil {
 			log.Println(err)
 			return
@@ -118,6 +160,55 @@ func main() {
 		log.Fatal("Gateway exited; error: ", err)
 	}
 
+	reloadGlobalConfig := func() {
+		old := gamma.GammaConfig()
+		if err := gamma.LoadGlobalConfig(globalConfigPath); err != nil {
+			log.Printf("Failed reloading %s; error: %s", globalConfigPath, err)
+			return
+		}
+		if keys := gamma.RestartRequired(old, gamma.GammaConfig()); len(keys) > 0 {
+			log.Printf("Changes of %s in %s only apply after a restart", strings.Join(keys, ", "), globalConfigPath)
+		}
+		if err := gateway.LoadAccessLists(); err != nil {
+			log.Println("Failed reloading access lists; error:", err)
+		}
+		gateway.UpdatePongData()
+		gateway.Publish(gamma.Event{Type: gamma.EventConfigReloaded})
+	}
+
+	if accessFile := gamma.GammaConfig().Access.File; accessFile != "" {
+		go func() {
+			err := gamma.WatchFile(accessFile, func() {
+				if err := gateway.LoadAccessLists(); err != nil {
+					log.Printf("Failed reloading %s; error: %s", accessFile, err)
+				}
+			})
+			if err != nil {
+				log.Printf("Failed watching %s; error: %s", accessFile, err)
+			}
+		}()
+	}
+
+	go func() {
+		if err := gamma.WatchGlobalConfig(globalConfigPath, reloadGlobalConfig); err != nil {
+			log.Printf("Failed watching %s; error: %s", globalConfigPath, err)
+		}
+	}()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for s := range sig {
+			log.Println("Received", s)
+			if s == syscall.SIGHUP {
+				reloadGlobalConfig()
+				continue
+			}
+			gateway.Shutdown(time.Duration(gamma.GammaConfig().DrainTimeout) * time.Millisecond)
+			return
+		}
+	}()
+
 	gateway.KeepProcessActive()
 
 }
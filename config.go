@@ -1,14 +1,25 @@
 package gamma
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"net"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 type Service struct {
@@ -16,6 +27,29 @@ type Service struct {
 	Bind    string `yaml:"bind"`
 }
 
+type ApiConfig struct {
+	Enabled bool       `yaml:"enabled"`
+	Bind    string     `yaml:"bind"`
+	Tokens  []ApiToken `yaml:"tokens"`
+	TLS     ApiTLS     `yaml:"tls"`
+	// Insecure allows serving the API without tokens on addresses other than loopback
+	Insecure bool `yaml:"insecure"`
+}
+
+// ApiToken is a bearer token that grants access to the API routes covered by its scopes.
+type ApiToken struct {
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// ApiTLS enables TLS for the API when Cert and Key are set. Client certificates signed by ClientCA are
+// required when ClientCA is set.
+type ApiTLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+}
+
 type Ping struct {
 	Edition         string `yaml:"edition"`
 	VersionName     string `yaml:"versionName"`
@@ -25,56 +59,147 @@ type Ping struct {
 	MaxPlayerCount  int    `yaml:"maxPlayerCount"`
 	Gamemode        string `yaml:"gamemode"`
 	GamemodeNumeric int    `yaml:"gamemodeNumeric"`
+	// Mode is either "static" to always show PlayerCount or "live" to show the players on the listener
+	Mode              string `yaml:"mode"`
+	RefreshInterval   int    `yaml:"refreshInterval"`
+	PlayerCountOffset int    `yaml:"playerCountOffset"`
+	PlayerCountCap    int    `yaml:"playerCountCap"`
+	// MaintenanceDescription replaces the description while all proxies of a listener are in maintenance
+	MaintenanceDescription string `yaml:"maintenanceDescription"`
+	// RateLimit limits the pings answered per source IP, pings over the limit are dropped
+	RateLimit RateLimit `yaml:"rateLimit"`
+	// GlobalRateLimit limits the pings answered from all source IPs together
+	GlobalRateLimit RateLimit `yaml:"globalRateLimit"`
+}
+
+// HandshakeLimits caps the sizes of the login of a client. MaxLoginSize applies to the decompressed login
+// batch, MaxChainSize to the JSON encoded certificate chain and MaxTokenSize to every single token.
+type HandshakeLimits struct {
+	MaxLoginSize int `yaml:"maxLoginSize"`
+	MaxChainSize int `yaml:"maxChainSize"`
+	MaxTokenSize int `yaml:"maxTokenSize"`
 }
 
 type GlobalConfig struct {
 	Prometheus           Service
-	Api                  Service
+	Api                  ApiConfig
 	Ping                 Ping
-	Debug                bool   `yaml:"debug"`
-	ReceiveProxyProtocol bool   `yaml:"receiveProxyProtocol"`
-	GenericJoinResponse  string `yaml:"genericJoinResponse"`
+	Debug                bool             `yaml:"debug"`
+	ReceiveProxyProtocol bool             `yaml:"receiveProxyProtocol"`
+	GenericJoinResponse  string           `yaml:"genericJoinResponse"`
+	DrainTimeout         int              `yaml:"drainTimeout"`
+	RateLimit            RateLimitConfig  `yaml:"rateLimit"`
+	AttackMode           AttackModeConfig `yaml:"attackMode"`
+	Access               AccessConfig     `yaml:"access"`
+	HandshakeLimits      HandshakeLimits  `yaml:"handshakeLimits"`
+	// PlayerBanFile is the json file with the player bans, it is reloaded whenever it changes
+	PlayerBanFile string `yaml:"playerBanFile"`
+	// BanMessage is shown to banned players, {username}, {reason} and {expires} are replaced
+	BanMessage string `yaml:"banMessage"`
 }
 
 type ProxyConfig struct {
 	sync.RWMutex
 	watcher *fsnotify.Watcher
+	path    string
 
 	removeCallback func()
-	changeCallback func()
+	changeCallback func() error
+
+	Domains            []string          `json:"domains"`
+	ListenTo           string            `json:"listenTo"`
+	ProxyTo            string            `json:"proxyTo"`
+	Backends           []BackendConfig   `json:"backends"`
+	Balancing          string            `json:"balancing"`
+	Fallbacks          []string          `json:"fallbacks"`
+	ProxyBind          string            `json:"proxyBind"`
+	DialTimeout        int               `json:"dialTimeout"`
+	DialTimeoutMessage string            `json:"dialTimeoutMessage"`
+	SendProxyProtocol  bool              `json:"sendProxyProtocol"`
+	PingPassthrough    bool              `json:"pingPassthrough"`
+	PingCacheTTL       int               `json:"pingCacheTTL"`
+	OfflineMotd        string            `json:"offlineMotd"`
+	HealthCheck        HealthCheckConfig `json:"healthCheck"`
+	Maintenance        bool              `json:"maintenance"`
+	MaintenanceMessage string            `json:"maintenanceMessage"`
+	MaintenanceBypass  []string          `json:"maintenanceBypass"`
+	OnlineMode         bool              `json:"onlineMode"`
+	OnlineModeMessage  string            `json:"onlineModeMessage"`
+	MaxPlayers         int               `json:"maxPlayers"`
+	FullMessage        string            `json:"fullMessage"`
+	FullBypass         []string          `json:"fullBypass"`
+	Allow              []string          `json:"allow"`
+	Deny               []string          `json:"deny"`
+}
+
+var globalConfig atomic.Value
 
-	Domains            []string `json:"domains"`
-	ListenTo           string   `json:"listenTo"`
-	ProxyTo            string   `json:"proxyTo"`
-	ProxyBind          string   `json:"proxyBind"`
-	DialTimeout        int      `json:"dialTimeout"`
-	DialTimeoutMessage string   `json:"dialTimeoutMessage"`
-	SendProxyProtocol  bool     `json:"sendProxyProtocol"`
+func init() {
+	config := DefaultConfig
+	globalConfig.Store(&config)
 }
 
-var GammaConfig GlobalConfig
+// GammaConfig returns the currently active global config. The returned config must not be modified, it
+// is swapped as a whole when the config is reloaded.
+func GammaConfig() *GlobalConfig {
+	return globalConfig.Load().(*GlobalConfig)
+}
 
 var DefaultConfig = GlobalConfig{
 	Debug:                false,
 	GenericJoinResponse:  "There is no proxy associated with this domain. Please check your configuration.",
 	ReceiveProxyProtocol: false,
+	DrainTimeout:         30000,
 	Prometheus: Service{
 		Enabled: false,
 		Bind:    ":9060",
 	},
-	Api: Service{
+	Api: ApiConfig{
 		Enabled: false,
 		Bind:    ":5000",
 	},
+	RateLimit: RateLimitConfig{
+		Enabled: false,
+		IP:      RateLimit{Rate: 2, Burst: 5},
+		Prefix:  RateLimit{Rate: 10, Burst: 30},
+		Global:  RateLimit{Rate: 200, Burst: 400},
+	},
+	AttackMode: AttackModeConfig{
+		Enabled:                  false,
+		ConnectionThreshold:      100,
+		FailedHandshakeThreshold: 30,
+		ConnectionCoolDown:       20,
+		FailedHandshakeCoolDown:  5,
+		CoolDown:                 60000,
+		HandshakeTimeout:         2000,
+		IP:                       RateLimit{Rate: 0.2, Burst: 2},
+		KnownIPTTL:               3600000,
+	},
+	Access: AccessConfig{
+		BanFile: "ip-bans.json",
+	},
+	HandshakeLimits: HandshakeLimits{
+		MaxLoginSize: 3 * 1024 * 1024,
+		MaxChainSize: 64 * 1024,
+		MaxTokenSize: 2 * 1024 * 1024,
+	},
+	PlayerBanFile: "player-bans.json",
+	BanMessage:    "You are banned from this server.\nReason: {reason}\nExpires: {expires}",
 	Ping: Ping{
-		Edition:         "MCPE",
-		VersionName:     "1.19.50",
-		VersionProtocol: 560,
-		Description:     "Gamma proxy",
-		PlayerCount:     0,
-		MaxPlayerCount:  10,
-		Gamemode:        "SURVIVAL",
-		GamemodeNumeric: 1,
+		Edition:           "MCPE",
+		VersionName:       "1.19.50",
+		VersionProtocol:   560,
+		Description:       "Gamma proxy",
+		PlayerCount:       0,
+		MaxPlayerCount:    10,
+		Gamemode:          "SURVIVAL",
+		GamemodeNumeric:   1,
+		Mode:              PongModeStatic,
+		RefreshInterval:   5000,
+		PlayerCountOffset: 0,
+		PlayerCountCap:    0,
+		RateLimit:         RateLimit{Rate: 10, Burst: 20},
+		GlobalRateLimit:   RateLimit{Rate: 1000, Burst: 2000},
 	},
 }
 
@@ -82,27 +207,203 @@ var DefaultProxyConfig = ProxyConfig{
 	Domains:            []string{"localhost"},
 	ListenTo:           ":19132",
 	ProxyTo:            "localhost:19133",
+	Balancing:          BalanceRoundRobin,
 	ProxyBind:          "",
 	DialTimeout:        1000,
 	DialTimeoutMessage: "Sorry but the server is offline.",
 	SendProxyProtocol:  false,
+	PingPassthrough:    false,
+	PingCacheTTL:       5000,
+	OfflineMotd:        "Server is offline",
+	HealthCheck:        DefaultHealthCheckConfig,
+	Maintenance:        false,
+	MaintenanceMessage: "The server is currently under maintenance.",
+	OnlineMode:         false,
+	OnlineModeMessage:  "You need to be signed in to XBOX Live to join this server.",
+	MaxPlayers:         0,
+	FullMessage:        "The server is full.",
 }
 
-func LoadGlobalConfig() error {
-	log.Println("Loading config.yml")
-	ymlFile, err := ioutil.ReadFile("config.yml")
-	if err != nil {
+// LoadGlobalConfig loads the global config from the yaml file at path and applies the GAMMA_ environment
+// overrides on top of it. A missing file is not an error, the defaults and environment are used instead.
+func LoadGlobalConfig(path string) error {
+	log.Println("Loading", path)
+	var config = DefaultConfig
+	ymlFile, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	var config = DefaultConfig
+	if os.IsNotExist(err) {
+		log.Printf("%s does not exist; using defaults", path)
+	}
 	err = yaml.Unmarshal(ymlFile, &config)
 	if err != nil {
 		return err
 	}
-	GammaConfig = config
+	if err := applyEnvOverrides(envPrefix, reflect.ValueOf(&config).Elem()); err != nil {
+		return err
+	}
+	if limits := config.HandshakeLimits; limits.MaxLoginSize <= 0 || limits.MaxChainSize <= 0 || limits.MaxTokenSize <= 0 {
+		return errors.New("handshakeLimits must be positive")
+	}
+	globalConfig.Store(&config)
+	return nil
+}
+
+// RestartRequired returns the keys of the settings that differ between old and new but are only applied
+// when gamma starts.
+func RestartRequired(old, new *GlobalConfig) []string {
+	var keys []string
+	if old.ReceiveProxyProtocol != new.ReceiveProxyProtocol {
+		keys = append(keys, "receiveProxyProtocol")
+	}
+	if old.Prometheus != new.Prometheus {
+		keys = append(keys, "prometheus")
+	}
+	if old.Api.Enabled != new.Api.Enabled || old.Api.Bind != new.Api.Bind || old.Api.TLS != new.Api.TLS {
+		keys = append(keys, "api")
+	}
+	if old.Access.File != new.Access.File || old.Access.BanFile != new.Access.BanFile {
+		keys = append(keys, "access.file/banFile")
+	}
+	if old.PlayerBanFile != new.PlayerBanFile {
+		keys = append(keys, "playerBanFile")
+	}
+	return keys
+}
+
+const envPrefix = "GAMMA_"
+
+// applyEnvOverrides overrides the fields of the struct v with environment variables. The variable name is
+// derived from the yaml key of every field, e.g. prometheus.bind is overridden by GAMMA_PROMETHEUS_BIND.
+func applyEnvOverrides(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		name := prefix + envName(key)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(name+"_", fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+			fv.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+			fv.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+			fv.SetFloat(f)
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("unsupported type for %s", name)
+			}
+			var values []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					values = append(values, s)
+				}
+			}
+			fv.Set(reflect.ValueOf(values))
+		default:
+			return fmt.Errorf("unsupported type for %s", name)
+		}
+	}
 	return nil
 }
 
+// envName converts a camelCase yaml key into an upper snake case environment variable name.
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// WatchGlobalConfig watches the global config file at path and calls onChange whenever it was written to.
+// The parent folder is watched instead of the file itself, so that editors replacing the file on save
+// don't end the watch.
+func WatchGlobalConfig(path string, onChange func()) error {
+	return WatchFile(path, onChange)
+}
+
+// WatchFile watches the file at path through its parent folder and calls onChange whenever it was written to.
+func WatchFile(path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	// The interval protects the watcher from write event spams
+	tick := time.NewTicker(time.Millisecond * 50)
+	defer tick.Stop()
+	changed := false
+
+	for {
+		select {
+		case <-tick.C:
+			if !changed {
+				continue
+			}
+			changed = false
+			onChange()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				changed = true
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Failed watching %s; error %s", path, err)
+		}
+	}
+}
+
 func readFilePaths(path string) ([]string, error) {
 	var filePaths []string
 	files, err := ioutil.ReadDir(path)
@@ -148,9 +449,18 @@ func NewProxyConfigFromPath(path string) (*ProxyConfig, error) {
 		return nil, err
 	}
 
+	if err := cfg.watchFile(path); err != nil {
+		return nil, err
+	}
+
+	return cfg, err
+}
+
+// watchFile starts watching the file at path for changes of the config.
+func (cfg *ProxyConfig) watchFile(path string) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	cfg.watcher = watcher
 
@@ -161,14 +471,28 @@ func NewProxyConfigFromPath(path string) (*ProxyConfig, error) {
 		log.Printf("Stopping to watch %s", path)
 	}()
 
-	if err := watcher.Add(path); err != nil {
+	return watcher.Add(path)
+}
+
+func LoadFromPath(path string) (*ProxyConfig, error) {
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
 
-	return cfg, err
+	config, err := NewProxyConfig(bb)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid proxy config %s: %w", path, err)
+	}
+	config.path = path
+	return config, nil
 }
 
-func LoadFromPath(path string) (*ProxyConfig, error) {
+// NewProxyConfig parses a ProxyConfig from json, fields that are left out keep their default value.
+func NewProxyConfig(bb []byte) (*ProxyConfig, error) {
 	var config *ProxyConfig
 
 	defaultCfg, err := json.Marshal(&DefaultProxyConfig)
@@ -181,16 +505,142 @@ func LoadFromPath(path string) (*ProxyConfig, error) {
 		return nil, err
 	}
 
-	bb, err := ioutil.ReadFile(path)
+	if err := json.Unmarshal(bb, &config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Name returns the name of the config, which is the file name without extension.
+func (cfg *ProxyConfig) Name() string {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return ProxyConfigName(cfg.path)
+}
+
+// ProxyConfigName returns the name of the proxy config stored at path.
+func ProxyConfigName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Validate checks the config for values that would prevent the proxy from working.
+func (cfg *ProxyConfig) Validate() error {
+	cfg.RLock()
+	defer cfg.RUnlock()
+
+	if len(cfg.Domains) == 0 {
+		return errors.New("domains must not be empty")
+	}
+	for _, domain := range cfg.Domains {
+		if domain == "" {
+			return errors.New("domains must not contain an empty domain")
+		}
+		if strings.HasPrefix(domain, regexDomainPrefix) {
+			if _, err := regexp.Compile(strings.TrimPrefix(domain, regexDomainPrefix)); err != nil {
+				return fmt.Errorf("invalid regex domain %s: %w", domain, err)
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(cfg.ListenTo); err != nil {
+		return fmt.Errorf("invalid listenTo: %w", err)
+	}
+	if len(cfg.Backends) == 0 && cfg.ProxyTo == "" {
+		return errors.New("either proxyTo or backends must be set")
+	}
+	for _, backend := range cfg.Backends {
+		if backend.Address == "" {
+			return errors.New("backends must not contain an empty address")
+		}
+		if backend.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for backend %s", backend.Weight, backend.Address)
+		}
+	}
+	for _, fallback := range cfg.Fallbacks {
+		if fallback == "" {
+			return errors.New("fallbacks must not contain an empty address")
+		}
+	}
+	switch cfg.Balancing {
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceWeighted:
+	default:
+		return fmt.Errorf("unknown balancing strategy %s", cfg.Balancing)
+	}
+	if cfg.DialTimeout <= 0 {
+		return errors.New("dialTimeout must be positive")
+	}
+	if cfg.ProxyBind != "" && net.ParseIP(cfg.ProxyBind) == nil {
+		return fmt.Errorf("invalid proxyBind %s", cfg.ProxyBind)
+	}
+	if cfg.MaxPlayers < 0 {
+		return errors.New("maxPlayers must not be negative")
+	}
+	if _, err := parseIPNetList(cfg.Allow); err != nil {
+		return fmt.Errorf("invalid allow list: %w", err)
+	}
+	if _, err := parseIPNetList(cfg.Deny); err != nil {
+		return fmt.Errorf("invalid deny list: %w", err)
+	}
+	return nil
+}
+
+// clone returns a copy of the values of the config, without its file watcher and callbacks.
+func (cfg *ProxyConfig) clone() (*ProxyConfig, error) {
+	cfg.RLock()
+	bb, err := json.Marshal(cfg)
+	cfg.RUnlock()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(bb, &config); err != nil {
+	var clone ProxyConfig
+	if err := json.Unmarshal(bb, &clone); err != nil {
 		return nil, err
 	}
+	return &clone, nil
+}
+
+// update replaces the values of the config with the values of other and notifies the gateway. The
+// previous values are restored if the gateway fails to apply them.
+func (cfg *ProxyConfig) update(other *ProxyConfig) error {
+	bb, err := json.Marshal(other)
+	if err != nil {
+		return err
+	}
 
-	return config, err
+	cfg.Lock()
+	previous, _ := json.Marshal(cfg)
+	err = json.Unmarshal(bb, cfg)
+	callback := cfg.changeCallback
+	cfg.Unlock()
+	if err != nil {
+		return err
+	}
+	return cfg.applyChange(previous, callback)
+}
+
+// applyChange applies the changed config through callback. If that fails the previous config is restored
+// and applied again, so the config keeps matching what is served.
+func (cfg *ProxyConfig) applyChange(previous []byte, callback func() error) error {
+	if callback == nil {
+		return nil
+	}
+	err := callback()
+	if err == nil {
+		return nil
+	}
+
+	cfg.Lock()
+	restoreErr := json.Unmarshal(previous, cfg)
+	cfg.Unlock()
+	if restoreErr == nil {
+		restoreErr = callback()
+	}
+	if restoreErr != nil {
+		log.Printf("Failed restoring the previous proxy config; error %s", restoreErr)
+	}
+	return err
 }
 
 func WatchProxyConfigFolder(path string, out chan *ProxyConfig) error {
@@ -246,8 +696,18 @@ func (cfg *ProxyConfig) watch(path string, interval time.Duration) {
 			if !ok {
 				return
 			}
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				cfg.removeCallback()
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// Files replaced by a rename, e.g. atomic saves, still exist and have to be watched again
+				if _, err := os.Stat(path); err == nil {
+					if err := cfg.watcher.Add(path); err != nil {
+						log.Printf("Failed watching %s; error %s", path, err)
+					}
+					lastEvent = &fsnotify.Event{Name: path, Op: fsnotify.Write}
+					continue
+				}
+				if cfg.removeCallback != nil {
+					cfg.removeCallback()
+				}
 				return
 			}
 			if event.Op&fsnotify.Write == fsnotify.Write {
@@ -263,19 +723,74 @@ func (cfg *ProxyConfig) watch(path string, interval time.Duration) {
 }
 
 func (cfg *ProxyConfig) onConfigWrite(event fsnotify.Event) {
-	log.Println("Updating", event.Name)
+	cfg.RLock()
+	before, _ := json.Marshal(cfg)
+	cfg.RUnlock()
+
 	if err := cfg.LoadFromPath(event.Name); err != nil {
 		log.Printf("Failed update on %s; error %s", event.Name, err)
 		return
 	}
-	cfg.changeCallback()
+
+	cfg.RLock()
+	after, _ := json.Marshal(cfg)
+	cfg.RUnlock()
+	// The gateway writes files of proxies it already applied, e.g. when updated through the API
+	if bytes.Equal(before, after) {
+		return
+	}
+
+	log.Println("Updating", event.Name)
+	if err := cfg.applyChange(before, cfg.changeCallback); err != nil {
+		log.Printf("Failed update on %s; error %s", event.Name, err)
+	}
 }
 
-// LoadFromPath loads the ProxyConfig from a file
-func (cfg *ProxyConfig) LoadFromPath(path string) error {
-	cfg.Lock()
-	defer cfg.Unlock()
+// stopWatching stops watching the file of the config.
+func (cfg *ProxyConfig) stopWatching() {
+	if cfg.watcher != nil {
+		_ = cfg.watcher.Close()
+	}
+}
 
+// WriteProxyConfig writes cfg to path atomically, by writing a temporary file in the same folder and
+// renaming it to path.
+func WriteProxyConfig(path string, cfg *ProxyConfig) error {
+	cfg.RLock()
+	bb, err := json.MarshalIndent(cfg, "", "  ")
+	cfg.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bb)
+}
+
+// writeFileAtomic writes bb to path by writing a temporary file in the same folder and renaming it to path.
+func writeFileAtomic(path string, bb []byte) error {
+	// The temporary file must not have the .json extension, or the folder watcher would pick it up
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bb); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFromPath loads the ProxyConfig from a file. The config is left unchanged if the file holds an
+// invalid config.
+func (cfg *ProxyConfig) LoadFromPath(path string) error {
 	var defaultCfg map[string]interface{}
 	bb, err := json.Marshal(&DefaultProxyConfig)
 	if err != nil {
@@ -305,5 +820,15 @@ func (cfg *ProxyConfig) LoadFromPath(path string) error {
 		return err
 	}
 
+	var loaded ProxyConfig
+	if err := json.Unmarshal(bb, &loaded); err != nil {
+		return err
+	}
+	if err := loaded.Validate(); err != nil {
+		return fmt.Errorf("invalid proxy config: %w", err)
+	}
+
+	cfg.Lock()
+	defer cfg.Unlock()
 	return json.Unmarshal(bb, cfg)
 }
@@ -0,0 +1,104 @@
+package gamma
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event published by the gateway.
+type EventType string
+
+const (
+	EventListenerUp         EventType = "listener_up"
+	EventListenerDown       EventType = "listener_down"
+	EventProxyRegistered    EventType = "proxy_registered"
+	EventProxyClosed        EventType = "proxy_closed"
+	EventPlayerLogin        EventType = "player_login"
+	EventPlayerRouted       EventType = "player_routed"
+	EventDialFailed         EventType = "dial_failed"
+	EventPlayerDisconnected EventType = "player_disconnected"
+	EventConfigReloaded     EventType = "config_reloaded"
+	EventUnderAttack        EventType = "under_attack"
+	EventAttackEnded        EventType = "attack_ended"
+)
+
+// Event is something that happened in the gateway. Fields that don't apply to the type are left empty.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Listener string    `json:"listener,omitempty"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Username string    `json:"username,omitempty"`
+	ClientIP string    `json:"clientIp,omitempty"`
+	Backend  string    `json:"backend,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// eventBus fans out events to its subscribers. Subscribers that can't keep up miss events instead of
+// blocking the gateway.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[chan Event]struct{}
+}
+
+func (bus *eventBus) publish(event Event) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (bus *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	bus.mu.Lock()
+	if bus.subscribers == nil {
+		bus.subscribers = map[chan Event]struct{}{}
+	}
+	bus.subscribers[ch] = struct{}{}
+	bus.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			delete(bus.subscribers, ch)
+			bus.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish publishes an event to all subscribers of the gateway.
+func (gateway *Gateway) Publish(event Event) {
+	gateway.events.publish(event)
+}
+
+// Subscribe returns a channel receiving the events of the gateway and a function that ends the
+// subscription. Events are dropped while the buffer of the channel is full.
+func (gateway *Gateway) Subscribe(buffer int) (<-chan Event, func()) {
+	return gateway.events.subscribe(buffer)
+}
+
+func (session *Session) event(t EventType) Event {
+	return Event{
+		Type:     t,
+		Proxy:    session.Proxy,
+		Session:  session.ID,
+		Username: session.Username,
+		ClientIP: session.ClientIP,
+		Backend:  session.Backend(),
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -25,16 +27,73 @@ var (
 		Name: "gamma_handshakes",
 		Help: "The total number of handshakes made to each proxy by type",
 	}, []string{"type", "host"})
+	handshakeErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_handshake_errors_total",
+		Help: "The total number of failed handshakes by reason",
+	}, []string{"reason"})
 )
 
+// handshakeErrorReason returns the metric label of an error returned by serve before the login was parsed.
+func handshakeErrorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errAccessDenied):
+		return "access_denied"
+	case errors.Is(err, errRateLimited):
+		return "rate_limited"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, protocol.ErrPacketTooLarge):
+		return "packet_too_large"
+	case errors.Is(err, protocol.ErrTooManyPackets):
+		return "too_many_packets"
+	case errors.Is(err, protocol.ErrMalformedPacket):
+		return "malformed_packet"
+	case errors.Is(err, login.ErrChainTooLarge):
+		return "chain_too_large"
+	case errors.Is(err, login.ErrTokenTooLarge):
+		return "token_too_large"
+	case errors.Is(err, login.ErrMalformedRequest):
+		return "malformed_login"
+	case errors.Is(err, login.ErrInvalidChain):
+		return "invalid_chain"
+	default:
+		return "other"
+	}
+}
+
 type Gateway struct {
 	listeners            sync.Map
 	Proxies              sync.Map
-	closed               chan bool
+	regexps              sync.Map
+	sessions             sync.Map
+	events               eventBus
 	wg                   sync.WaitGroup
 	ReceiveProxyProtocol bool
-	underAttack          bool
-	connections          int
+	// ConfigPath is the folder proxies created through the API are persisted to, they only live in
+	// memory if it is empty
+	ConfigPath string
+
+	registerMu    sync.Mutex
+	mu            sync.Mutex
+	closing       bool
+	ready         bool
+	conns         map[net.Conn]struct{}
+	connsWg       sync.WaitGroup
+	metricsServer *http.Server
+	apiServer     *http.Server
+	done          chan struct{}
+	// players holds the number of players being proxied per listener address
+	players     map[string]int
+	limiter     rateLimiter
+	underAttack attackMonitor
+	access      accessControl
+	bans        playerBans
+	pingLimiter rateLimiter
+	// pongs caches the last pong handed to every listener
+	pongMu  sync.Mutex
+	pongs   map[*raknet.Listener]cachedPong
+	pongSeq uint64
 }
 
 func (gateway *Gateway) KeepProcessActive() {
@@ -42,15 +101,27 @@ func (gateway *Gateway) KeepProcessActive() {
 }
 
 func (gateway *Gateway) EnablePrometheus(bind string) error {
-	gateway.wg.Add(1)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	gateway.registerStatusRoutes(mux)
+	server := &http.Server{Addr: bind, Handler: mux}
+
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+
+	gateway.mu.Lock()
+	gateway.metricsServer = server
+	gateway.mu.Unlock()
 
+	gateway.wg.Add(1)
 	go func() {
 		defer gateway.wg.Done()
 
-		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(bind, nil)
-		if err != nil {
-			panic(err)
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("Prometheus metrics endpoint stopped; error:", err)
 		}
 	}()
 
@@ -58,109 +129,386 @@ func (gateway *Gateway) EnablePrometheus(bind string) error {
 	return nil
 }
 
+// Close closes every listener of the gateway immediately, dropping all connected players.
 func (gateway *Gateway) Close() {
 	gateway.listeners.Range(func(k, v interface{}) bool {
-		gateway.closed <- true
+		gateway.listeners.Delete(k)
+		gateway.forgetPong(v.(*raknet.Listener))
 		_ = v.(*raknet.Listener).Close()
-		return false
+		return true
 	})
 }
 
+// Shutdown stops the gateway from accepting new connections and waits up to timeout for the connected
+// players to leave. Connections that are still open after the timeout are closed forcefully. Once all
+// connections are gone the listeners and the metrics endpoint are closed, which unblocks KeepProcessActive.
+func (gateway *Gateway) Shutdown(timeout time.Duration) {
+	gateway.mu.Lock()
+	if gateway.closing {
+		gateway.mu.Unlock()
+		return
+	}
+	gateway.closing = true
+	// Keep the process active until the shutdown completed
+	gateway.wg.Add(1)
+	defer gateway.wg.Done()
+	if gateway.done == nil {
+		gateway.done = make(chan struct{})
+	}
+	close(gateway.done)
+	log.Printf("Shutting down gateway; draining %d connections", len(gateway.conns))
+	gateway.mu.Unlock()
+
+	// Listeners have to stay open while draining, closing a raknet listener closes the underlying
+	// socket which is shared with every connection accepted by it.
+	drained := make(chan struct{})
+	go func() {
+		gateway.connsWg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		gateway.mu.Lock()
+		log.Printf("Drain timeout exceeded; closing %d remaining connections", len(gateway.conns))
+		for conn := range gateway.conns {
+			_ = conn.Close()
+		}
+		gateway.mu.Unlock()
+		<-drained
+	}
+
+	gateway.Close()
+
+	gateway.mu.Lock()
+	servers := []*http.Server{gateway.metricsServer, gateway.apiServer}
+	gateway.mu.Unlock()
+	for _, server := range servers {
+		if server != nil {
+			_ = server.Close()
+		}
+	}
+	log.Println("Gateway shut down")
+}
+
+// trackConn registers an accepted connection so that Shutdown can drain it. It returns false if the
+// gateway is shutting down and the connection should be rejected.
+func (gateway *Gateway) trackConn(conn net.Conn) bool {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.closing {
+		return false
+	}
+	if gateway.conns == nil {
+		gateway.conns = map[net.Conn]struct{}{}
+	}
+	gateway.conns[conn] = struct{}{}
+	gateway.connsWg.Add(1)
+	return true
+}
+
+// doneChan returns a channel that is closed once the gateway starts shutting down.
+func (gateway *Gateway) doneChan() <-chan struct{} {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.done == nil {
+		gateway.done = make(chan struct{})
+	}
+	return gateway.done
+}
+
+// addPlayers adjusts the number of players being proxied through the listener on addr by delta.
+func (gateway *Gateway) addPlayers(addr string, delta int) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.players == nil {
+		gateway.players = map[string]int{}
+	}
+	gateway.players[addr] += delta
+	if gateway.players[addr] <= 0 {
+		delete(gateway.players, addr)
+	}
+}
+
+// ListenerPlayers returns the number of players being proxied through the listener on addr.
+func (gateway *Gateway) ListenerPlayers(addr string) int {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	return gateway.players[addr]
+}
+
+func (gateway *Gateway) untrackConn(conn net.Conn) {
+	gateway.mu.Lock()
+	delete(gateway.conns, conn)
+	gateway.mu.Unlock()
+	gateway.connsWg.Done()
+}
+
 func (gateway *Gateway) CloseProxy(proxyUID string) {
 	log.Println("Closing config with UID", proxyUID)
 	v, ok := gateway.Proxies.Load(proxyUID)
 	if !ok {
 		return
 	}
-	proxy := v.(*Proxy)
+	gateway.closeProxy(v.(*Proxy))
+}
 
-	uids := proxy.DomainNames()
-	for _, uid := range uids {
-		log.Println("Closing proxy with UID", uid)
-		gateway.Proxies.Delete(uid)
+// closeProxy unregisters every UID of the proxy and closes its listeners if no other proxy uses them.
+func (gateway *Gateway) closeProxy(proxy *Proxy) {
+	addrs, ok := gateway.unregisterProxy(proxy)
+	if !ok {
+		return
 	}
 
+	proxy.stopHealthChecks()
+	gateway.Publish(Event{Type: EventProxyClosed, Proxy: proxy.UID})
+
 	playersConnected.DeleteLabelValues(proxy.DomainName())
+	for _, backend := range proxy.Backends() {
+		backendPlayersConnected.DeleteLabelValues(proxy.DomainName(), backend.Address)
+		backendHealthy.DeleteLabelValues(proxy.DomainName(), backend.Address)
+	}
+	for _, backend := range proxy.Fallbacks() {
+		backendPlayersConnected.DeleteLabelValues(proxy.DomainName(), backend.Address)
+	}
 
-	closeListener := true
+	gateway.closeUnusedListeners(addrs)
+}
+
+// reloadProxy registers the proxy again after its config changed. Listeners that are still used by the
+// proxy stay open, so that connected players are not dropped. The new config is checked and its listener
+// bound before the proxy is unregistered, if that fails the proxy is left registered as before.
+func (gateway *Gateway) reloadProxy(proxy *Proxy) error {
+	if err := gateway.checkProxy(proxy); err != nil {
+		return err
+	}
+	addr := proxy.ListenTo()
+	if _, ok := gateway.listeners.Load(addr); !ok {
+		log.Println("Creating listener on", addr)
+		listener, err := gateway.listen(addr)
+		if err != nil {
+			return err
+		}
+		gateway.serveListener(addr, listener)
+	}
+
+	addrs, _ := gateway.unregisterProxy(proxy)
+	err := gateway.RegisterProxy(proxy)
+	gateway.closeUnusedListeners(addrs)
+	gateway.UpdatePongData()
+	if err != nil {
+		return err
+	}
+	gateway.Publish(Event{Type: EventConfigReloaded, Proxy: proxy.UID})
+	return nil
+}
+
+// unregisterProxy removes every UID of the proxy and returns the listener addresses they were registered
+// on. The UIDs are looked up by value, as the config of the proxy might already hold new domains.
+func (gateway *Gateway) unregisterProxy(proxy *Proxy) (map[string]bool, bool) {
+	found := false
+	addrs := map[string]bool{}
 	gateway.Proxies.Range(func(k, v interface{}) bool {
-		otherProxy := v.(*Proxy)
-		if proxy.ListenTo() == otherProxy.ListenTo() {
-			closeListener = false
-			return false
+		if v.(*Proxy) != proxy {
+			return true
 		}
+		uid := k.(string)
+		log.Println("Closing proxy with UID", uid)
+		gateway.Proxies.Delete(uid)
+		addrs[uid[strings.LastIndex(uid, "@")+1:]] = true
+		found = true
 		return true
 	})
+	return addrs, found
+}
 
-	if !closeListener {
-		return
+// closeUnusedListeners closes the listeners on addrs that no proxy is registered on anymore.
+func (gateway *Gateway) closeUnusedListeners(addrs map[string]bool) {
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		uid := k.(string)
+		delete(addrs, uid[strings.LastIndex(uid, "@")+1:])
+		return true
+	})
+
+	for addr := range addrs {
+		v, ok := gateway.listeners.LoadAndDelete(addr)
+		if !ok {
+			continue
+		}
+		log.Println("Closing listener on", addr)
+		gateway.forgetPong(v.(*raknet.Listener))
+		_ = v.(*raknet.Listener).Close()
+	}
+}
+
+// RegisterProxyConfig registers a proxy for a config loaded from the configs folder. Configs of proxies
+// that are already registered under the same name are ignored, this happens when a file that the gateway
+// wrote itself is picked up by the folder watcher.
+func (gateway *Gateway) RegisterProxyConfig(cfg *ProxyConfig) error {
+	gateway.registerMu.Lock()
+	defer gateway.registerMu.Unlock()
+
+	name := cfg.Name()
+	if _, ok := gateway.ProxyByName(name); ok {
+		cfg.stopWatching()
+		return nil
+	}
+	return gateway.RegisterProxy(NewProxy(name, cfg))
+}
+
+// PutProxy creates the proxy name with cfg, or replaces the config of the proxy if it already exists, and
+// reports whether it was created. The config is written to ConfigPath if set.
+func (gateway *Gateway) PutProxy(name string, cfg *ProxyConfig) (bool, error) {
+	gateway.registerMu.Lock()
+	defer gateway.registerMu.Unlock()
+
+	// Proxies are only persisted once they are registered, so that a config that can't be served is
+	// neither picked up by the folder watcher nor loaded again on restart
+	if proxy, exists := gateway.ProxyByName(name); exists {
+		previous, err := proxy.Config.clone()
+		if err != nil {
+			return false, err
+		}
+		if err := proxy.Config.update(cfg); err != nil {
+			return false, err
+		}
+		if err := gateway.persistProxy(name, proxy.Config, cfg); err != nil {
+			if restoreErr := proxy.Config.update(previous); restoreErr != nil {
+				log.Printf("Failed restoring the previous config of %s; error %s", name, restoreErr)
+			}
+			return false, err
+		}
+		return false, nil
+	}
+
+	proxy := NewProxy(name, cfg)
+	if err := gateway.RegisterProxy(proxy); err != nil {
+		gateway.closeProxy(proxy)
+		return false, err
+	}
+	if err := gateway.persistProxy(name, cfg, cfg); err != nil {
+		gateway.closeProxy(proxy)
+		return false, err
 	}
+	return true, nil
+}
 
-	v, ok = gateway.listeners.Load(proxy.ListenTo())
+// persistProxy writes cfg to the file of the proxy name in ConfigPath and starts watching the file for
+// changes of watched, the config the proxy is running with.
+func (gateway *Gateway) persistProxy(name string, watched, cfg *ProxyConfig) error {
+	if gateway.ConfigPath == "" {
+		return nil
+	}
+	path := filepath.Join(gateway.ConfigPath, name+".json")
+	if err := WriteProxyConfig(path, cfg); err != nil {
+		return err
+	}
+
+	if watched.watcher == nil {
+		watched.path = path
+		if err := watched.watchFile(path); err != nil {
+			log.Printf("Failed watching %s; error %s", path, err)
+		}
+	}
+	return nil
+}
+
+// DeleteProxy closes the proxy name and removes its config file. It reports whether the proxy existed.
+func (gateway *Gateway) DeleteProxy(name string) (bool, error) {
+	gateway.registerMu.Lock()
+	defer gateway.registerMu.Unlock()
+
+	proxy, ok := gateway.ProxyByName(name)
 	if !ok {
-		return
+		return false, nil
+	}
+	gateway.closeProxy(proxy)
+	proxy.Config.stopWatching()
+
+	proxy.Config.RLock()
+	path := proxy.Config.path
+	proxy.Config.RUnlock()
+	if path == "" {
+		return true, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return true, err
 	}
-	_ = v.(*raknet.Listener).Close()
+	return true, nil
 }
 
 func (gateway *Gateway) RegisterProxy(proxy *Proxy) error {
 	// Register new Proxy
+	if err := gateway.checkProxy(proxy); err != nil {
+		return err
+	}
+	proxy.syncBackends()
+
 	uids := proxy.UIDs()
 	for _, uid := range uids {
 		log.Println("Registering proxy with UID", uid)
 		gateway.Proxies.Store(uid, proxy)
 	}
-	proxyUID := proxy.UID
-
 	proxy.Config.removeCallback = func() {
-		gateway.CloseProxy(proxyUID)
+		gateway.closeProxy(proxy)
 	}
 
-	proxy.Config.changeCallback = func() {
-		gateway.CloseProxy(proxyUID)
-		if err := gateway.RegisterProxy(proxy); err != nil {
-			log.Println(err)
-		}
+	proxy.Config.changeCallback = func() error {
+		return gateway.reloadProxy(proxy)
 	}
 
+	proxy.events = &gateway.events
 	playersConnected.WithLabelValues(proxy.DomainName())
+	proxy.startHealthChecks()
+	gateway.Publish(Event{Type: EventProxyRegistered, Proxy: proxy.UID, Listener: proxy.ListenTo()})
 
 	// Check if a gate is already listening to the Proxy address
 	addr := proxy.ListenTo()
 	if _, ok := gateway.listeners.Load(addr); ok {
+		// The pong may depend on the proxies of the listener
+		gateway.updateListenerPong(addr)
 		return nil
 	}
 
 	log.Println("Creating listener on", addr)
-	listener, err := raknet.Listen(addr)
+	listener, err := gateway.listen(addr)
 	if err != nil {
 		return err
 	}
+	gateway.serveListener(addr, listener)
+	return nil
+}
+
+// checkProxy parses the access lists and compiles the regex domains of the proxy, so that a config that
+// can't be served is rejected before it is registered.
+func (gateway *Gateway) checkProxy(proxy *Proxy) error {
+	if err := proxy.parseAccessLists(); err != nil {
+		return err
+	}
+	for _, domain := range proxy.DomainNames() {
+		if strings.HasPrefix(domain, regexDomainPrefix) {
+			if _, err := gateway.compileDomainRegex(domain); err != nil {
+				return fmt.Errorf("invalid regex domain %s: %w", domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// serveListener stores the bound listener of addr and serves its connections.
+func (gateway *Gateway) serveListener(addr string, listener *raknet.Listener) {
 	gateway.listeners.Store(addr, listener)
+	gateway.Publish(Event{Type: EventListenerUp, Listener: addr})
 
-	listener.PongData(marshalPong(listener))
+	gateway.updateListenerPong(addr)
 
 	gateway.wg.Add(1)
 	go func() {
 		if err := gateway.listenAndServe(listener, addr); err != nil {
-			log.Printf("Failed to listen on %s; error: %s", proxy.ListenTo(), err)
+			log.Printf("Failed to listen on %s; error: %s", addr, err)
 		}
 	}()
-	return nil
-}
-
-func marshalPong(l *raknet.Listener) []byte {
-	motd := strings.Split(GammaConfig.Ping.Description, "\n")
-	motd1 := motd[0]
-	motd2 := ""
-	if len(motd) > 1 {
-		motd2 = motd[1]
-	}
-
-	port := l.Addr().(*net.UDPAddr).Port
-	return []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;",
-		GammaConfig.Ping.Edition, motd1, GammaConfig.Ping.VersionProtocol, GammaConfig.Ping.VersionName, GammaConfig.Ping.PlayerCount, GammaConfig.Ping.MaxPlayerCount,
-		l.ID(), motd2, GammaConfig.Ping.Gamemode, GammaConfig.Ping.GamemodeNumeric, port, port))
 }
 
 func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
@@ -168,8 +516,6 @@ func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
 		return errors.New("no proxies in gateway")
 	}
 
-	gateway.closed = make(chan bool, len(proxies))
-
 	for _, proxy := range proxies {
 		if err := gateway.RegisterProxy(proxy); err != nil {
 			gateway.Close()
@@ -177,34 +523,68 @@ func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
 		}
 	}
 
+	go gateway.refreshPongData()
+	go gateway.monitorAttacks()
+
+	gateway.setReady()
 	log.Println("All proxies are online")
 	return nil
 }
 
 func (gateway *Gateway) listenAndServe(listener *raknet.Listener, addr string) error {
 	defer gateway.wg.Done()
+	defer gateway.Publish(Event{Type: EventListenerDown, Listener: addr})
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println(err)
+			// The listener was closed on purpose if it is no longer registered
+			if v, ok := gateway.listeners.Load(addr); !ok || v != listener {
+				return nil
+			}
+			// Forget the broken listener so that it is reported as unbound
+			gateway.listeners.Delete(addr)
+			return err
+		}
+
+		// Drop connections over the rate limits before spawning a goroutine or decoding anything
+		gateway.underAttack.connection()
+		scope := limitAll
+		if gateway.ReceiveProxyProtocol {
+			scope = limitGlobal
+		}
+		if !gateway.allowConn(conn.RemoteAddr(), addr, scope) {
+			_ = conn.Close()
+			continue
+		}
+
+		// The real address of the client is only known after reading the PROXY protocol header in serve
+		if !gateway.ReceiveProxyProtocol && !gateway.admit(conn.RemoteAddr(), addr) {
+			_ = conn.Close()
+			continue
+		}
+
+		if !gateway.trackConn(conn) {
+			_ = conn.Close()
+			continue
 		}
 
 		go func() {
-			if GammaConfig.Debug {
+			if GammaConfig().Debug {
 				log.Printf("[>] Incoming %s on listener %s", conn.RemoteAddr(), addr)
 			}
+			defer gateway.untrackConn(conn)
 			defer conn.Close()
-			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_ = conn.SetDeadline(time.Now().Add(gateway.handshakeTimeout()))
 			if err := gateway.serve(conn, addr); err != nil {
 
-				if GammaConfig.Debug {
+				if GammaConfig().Debug {
 					log.Printf("[x] %s closed connection with %s; error: %s", conn.RemoteAddr(), addr, err)
 				}
 				return
 			}
 			_ = conn.SetDeadline(time.Time{})
-			if GammaConfig.Debug {
+			if GammaConfig().Debug {
 				log.Printf("[x] %s closed connection with %s", conn.RemoteAddr(), addr)
 			}
 		}()
@@ -212,6 +592,13 @@ func (gateway *Gateway) listenAndServe(listener *raknet.Listener, addr string) e
 }
 
 func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
+	handshaken := false
+	defer func() {
+		if rerr != nil && !handshaken {
+			gateway.underAttack.failedHandshake()
+			handshakeErrorCount.With(prometheus.Labels{"reason": handshakeErrorReason(rerr)}).Inc()
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			switch x := r.(type) {
@@ -236,8 +623,16 @@ func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
 			return err
 		}
 		pc.RemoteAddr = header.SourceAddr
+		if !gateway.allowConn(pc.RemoteAddr, addr, limitClient) {
+			return errRateLimited
+		}
+		if !gateway.admit(pc.RemoteAddr, addr) {
+			return errAccessDenied
+		}
 	}
 
+	limits := GammaConfig().HandshakeLimits
+
 	b, err := pc.ReadPacket()
 	if err != nil {
 		return err
@@ -246,6 +641,12 @@ func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
 	var reqpacket protocol.RequestNetworkSettings
 	reqdecoder := protocol.NewDecoder(bytes.NewReader(b))
 	reqpks, err := reqdecoder.Decode()
+	if err != nil {
+		return err
+	}
+	if len(reqpks) < 1 {
+		return fmt.Errorf("%w: no network settings request received", protocol.ErrMalformedPacket)
+	}
 	err = protocol.UnmarshalPacket(reqpks[0], &reqpacket)
 	if err != nil {
 		return err
@@ -265,13 +666,14 @@ func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
 
 	decoder := protocol.NewDecoder(bytes.NewReader(loginPacket))
 	decoder.EnableCompression(protocol.FlateCompression{})
+	decoder.SetMaxBatchSize(limits.MaxLoginSize)
 	pks, err := decoder.Decode()
 	if err != nil {
 		return err
 	}
 
 	if len(pks) < 1 {
-		return errors.New("no valid packets received")
+		return fmt.Errorf("%w: no valid packets received", protocol.ErrMalformedPacket)
 	}
 
 	var loginPk protocol.Login
@@ -279,13 +681,27 @@ func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
 		return err
 	}
 
-	iData, cData, err := login.Parse(loginPk.ConnectionRequest)
+	iData, cData, auth, err := login.ParseWithLimits(loginPk.ConnectionRequest, login.Limits{
+		MaxChainSize: limits.MaxChainSize,
+		MaxTokenSize: limits.MaxTokenSize,
+	})
 	if err != nil {
 		return err
 	}
+	handshaken = true
 	pc.Username = iData.DisplayName
+	pc.XUID = iData.XUID
+	pc.UUID = iData.Identity
+	gateway.Publish(Event{Type: EventPlayerLogin, Listener: addr, Username: pc.Username, ClientIP: clientIP(pc.RemoteAddr), Message: cData.ServerAddress})
 	pc.ServerAddr = cData.ServerAddress
 
+	if ban, ok := gateway.PlayerBan(pc.XUID, pc.UUID, pc.Username); ok {
+		if GammaConfig().Debug {
+			log.Printf("[i] %s rejected; %s is banned", pc.RemoteAddr, pc.Username)
+		}
+		return pc.Disconnect(ban.Message(GammaConfig().BanMessage, pc.Username))
+	}
+
 	if strings.Contains(pc.ServerAddr, ":") {
 		pc.ServerAddr, _, err = net.SplitHostPort(pc.ServerAddr)
 		if err != nil {
@@ -294,32 +710,68 @@ func (gateway *Gateway) serve(conn net.Conn, addr string) (rerr error) {
 	}
 
 	proxyUID := proxyUID(pc.ServerAddr, addr)
-	if GammaConfig.Debug {
+	if GammaConfig().Debug {
 		log.Printf("[i] %s requests proxy with UID %s", pc.RemoteAddr, proxyUID)
 	}
 
-	v, ok := gateway.Proxies.Load(proxyUID)
+	route, ok := gateway.findRoute(pc.ServerAddr, addr)
 	if !ok {
-		v, ok = gateway.Proxies.Load(fmt.Sprintf("*@%s", addr))
-		if !ok {
-			err = pc.Disconnect(GammaConfig.GenericJoinResponse)
-			if err != nil {
-				return err
-			}
-			return nil
+		err = pc.Disconnect(GammaConfig().GenericJoinResponse)
+		if err != nil {
+			return err
 		}
+		return nil
 	}
 
-	proxy := v.(*Proxy)
+	proxy := route.proxy
 	handshakeCount.With(prometheus.Labels{"type": "login", "host": proxy.DomainName()}).Inc()
 
-	if GammaConfig.Debug {
+	if ip := net.ParseIP(clientIP(pc.RemoteAddr)); ip != nil && !proxy.AllowsIP(ip) {
+		accessDeniedCount.With(prometheus.Labels{"listener": addr, "reason": AccessProxy}).Inc()
+		if GammaConfig().Debug {
+			log.Printf("[i] %s rejected by the access lists of %s", pc.RemoteAddr, proxy.DomainName())
+		}
+		return errAccessDenied
+	}
+
+	if proxy.OnlineMode() && !auth.XBOXLiveAuthenticated {
+		if GammaConfig().Debug {
+			log.Printf("[i] %s rejected by online mode of %s", pc.RemoteAddr, proxy.DomainName())
+		}
+		return pc.Disconnect(proxy.OnlineModeMessage())
+	}
+
+	if proxy.Maintenance() && !proxy.BypassesMaintenance(pc.Username, pc.XUID, auth.XBOXLiveAuthenticated) {
+		if GammaConfig().Debug {
+			log.Printf("[i] %s rejected by maintenance of %s", pc.RemoteAddr, proxy.DomainName())
+		}
+		return pc.Disconnect(proxy.MaintenanceMessage())
+	}
+
+	if GammaConfig().Debug {
 		log.Printf("[i] %s connecting through config %s", pc.RemoteAddr, proxy.DomainName())
 	}
 
+	// The slot is taken before the player is counted anywhere, so that players of a full proxy never show up
+	if !proxy.reserveSlot(pc.XUID) {
+		return proxy.rejectFull(pc)
+	}
+	defer proxy.releaseSlot()
+
 	_ = conn.SetDeadline(time.Time{})
+	gateway.underAttack.rememberIP(clientIP(pc.RemoteAddr))
+
+	gateway.addPlayers(addr, 1)
+	defer gateway.addPlayers(addr, -1)
+
+	session := newSession(pc, proxy.UID)
+	gateway.addSession(session)
+	defer gateway.removeSession(session)
+	defer func() {
+		gateway.Publish(session.event(EventPlayerDisconnected))
+	}()
 
-	err = proxy.HandleLogin(pc)
+	err = proxy.handleLogin(pc, route, session)
 	if err != nil {
 		return err
 	}
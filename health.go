@@ -0,0 +1,153 @@
+package gamma
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gamma_backend_healthy",
+		Help: "Whether a backend passes its health checks (1) or not (0)",
+	}, []string{"host", "backend"})
+)
+
+// HealthCheckConfig configures the active health checks of the backends of a proxy. A backend is marked
+// unhealthy after Fall failed pings in a row and healthy again after Rise successful pings in a row.
+type HealthCheckConfig struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"`
+	Timeout  int  `json:"timeout"`
+	Rise     int  `json:"rise"`
+	Fall     int  `json:"fall"`
+}
+
+var DefaultHealthCheckConfig = HealthCheckConfig{
+	Enabled:  false,
+	Interval: 5000,
+	Timeout:  1000,
+	Rise:     2,
+	Fall:     3,
+}
+
+// Healthy reports whether the backend passes its health checks. Backends are healthy until proven
+// otherwise, and always when health checks are disabled.
+func (backend *Backend) Healthy() bool {
+	return atomic.LoadInt32(&backend.unhealthy) == 0
+}
+
+func (backend *Backend) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&backend.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&backend.unhealthy, 1)
+	}
+}
+
+// check pings the backend once and updates its health according to the rise and fall thresholds.
+func (backend *Backend) check(host string, cfg HealthCheckConfig) {
+	// Addresses with capture group substitutions are only known once a player connects
+	if strings.Contains(backend.Address, "$") {
+		return
+	}
+
+	_, err := raknet.PingTimeout(backend.Address, time.Duration(cfg.Timeout)*time.Millisecond)
+	if err == nil {
+		backend.successes++
+		backend.failures = 0
+		if !backend.Healthy() && backend.successes >= cfg.Rise {
+			log.Printf("[i] Backend %s of %s is healthy again", backend.Address, host)
+			backend.setHealthy(true)
+		}
+	} else {
+		backend.failures++
+		backend.successes = 0
+		if backend.Healthy() && backend.failures >= cfg.Fall {
+			log.Printf("[i] Backend %s of %s is unhealthy; error: %s", backend.Address, host, err)
+			backend.setHealthy(false)
+		}
+	}
+
+	value := 0.0
+	if backend.Healthy() {
+		value = 1
+	}
+	backendHealthy.WithLabelValues(host, backend.Address).Set(value)
+}
+
+func (proxy *Proxy) HealthCheck() HealthCheckConfig {
+	proxy.Config.RLock()
+	cfg := proxy.Config.HealthCheck
+	proxy.Config.RUnlock()
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHealthCheckConfig.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHealthCheckConfig.Timeout
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = DefaultHealthCheckConfig.Rise
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = DefaultHealthCheckConfig.Fall
+	}
+	return cfg
+}
+
+func (proxy *Proxy) startHealthChecks() {
+	proxy.backendsMu.Lock()
+	defer proxy.backendsMu.Unlock()
+	if proxy.healthDone != nil {
+		return
+	}
+	proxy.healthDone = make(chan struct{})
+	go proxy.healthChecks(proxy.healthDone)
+}
+
+func (proxy *Proxy) stopHealthChecks() {
+	proxy.backendsMu.Lock()
+	defer proxy.backendsMu.Unlock()
+	if proxy.healthDone == nil {
+		return
+	}
+	close(proxy.healthDone)
+	proxy.healthDone = nil
+}
+
+// healthChecks pings every backend of the proxy each interval until done is closed.
+func (proxy *Proxy) healthChecks(done chan struct{}) {
+	for {
+		cfg := proxy.HealthCheck()
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(cfg.Interval) * time.Millisecond):
+		}
+
+		host := proxy.DomainName()
+		backends := proxy.Backends()
+		if !cfg.Enabled {
+			for _, backend := range backends {
+				backend.setHealthy(true)
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, backend := range backends {
+			wg.Add(1)
+			go func(backend *Backend) {
+				defer wg.Done()
+				backend.check(host, cfg)
+			}(backend)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,138 @@
+package gamma
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"net"
+)
+
+const (
+	// idUnconnectedPing and idUnconnectedPingOpenConnections are the raknet IDs of server list pings. Packets
+	// of connected clients are datagrams, which never start with these bytes.
+	idUnconnectedPing                = 0x01
+	idUnconnectedPingOpenConnections = 0x02
+
+	// RateLimitPing drops pings of sources that exceed the ping rate limit
+	RateLimitPing = "ping"
+)
+
+var (
+	pingCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_pings_total",
+		Help: "The total number of unconnected pings received per listener",
+	}, []string{"listener"})
+)
+
+// cachedPong is the last pong handed to a listener and the sequence number it was built with.
+type cachedPong struct {
+	seq  uint64
+	data []byte
+}
+
+// pingFilter creates the packet connections of the raknet listeners, which drop pings of sources that
+// exceed the ping rate limit before raknet answers them.
+type pingFilter struct {
+	gateway  *Gateway
+	listener string
+}
+
+func (f pingFilter) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &pingFilterConn{
+		PacketConn: conn,
+		gateway:    f.gateway,
+		listener:   f.listener,
+		pings:      pingCount.With(prometheus.Labels{"listener": f.listener}),
+	}, nil
+}
+
+type pingFilterConn struct {
+	net.PacketConn
+	gateway  *Gateway
+	listener string
+	pings    prometheus.Counter
+}
+
+func (conn *pingFilterConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+		if err != nil || n == 0 || (b[0] != idUnconnectedPing && b[0] != idUnconnectedPingOpenConnections) {
+			return n, addr, err
+		}
+		conn.pings.Inc()
+		if conn.gateway.allowPing(addr, conn.listener) {
+			return n, addr, err
+		}
+	}
+}
+
+// listen creates a raknet listener on addr that is protected by the ping rate limit.
+func (gateway *Gateway) listen(addr string) (*raknet.Listener, error) {
+	return raknet.ListenConfig{UpstreamPacketListener: pingFilter{gateway: gateway, listener: addr}}.Listen(addr)
+}
+
+// allowPing reports whether a ping from addr is within the ping rate limits. Rejected pings are counted
+// and dropped without a pong, so that the gateway can't be used to reflect traffic. The global limit caps
+// the pongs sent to spoofed source addresses, which each get a bucket of their own.
+func (gateway *Gateway) allowPing(addr net.Addr, listener string) bool {
+	cfg := GammaConfig().Ping
+	if cfg.RateLimit.Rate <= 0 && cfg.GlobalRateLimit.Rate <= 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP(addr))
+	if ok, _ := gateway.pingLimiter.allow(ip, RateLimitConfig{Enabled: true, IP: cfg.RateLimit, Global: cfg.GlobalRateLimit}); ok {
+		return true
+	}
+	rateLimitedCount.With(prometheus.Labels{"listener": listener, "reason": RateLimitPing}).Inc()
+	if GammaConfig().Debug {
+		log.Printf("[!] Dropped ping of %s on listener %s; reason: %s", addr, listener, RateLimitPing)
+	}
+	return false
+}
+
+// updateListenerPong recomputes the pong of the listener on addr and hands it to raknet if it changed.
+// Raknet answers every ping with the last pong it got, so pings never trigger any work in the gateway.
+func (gateway *Gateway) updateListenerPong(addr string) {
+	v, ok := gateway.listeners.Load(addr)
+	if !ok {
+		return
+	}
+	listener := v.(*raknet.Listener)
+
+	// The pong is built outside the lock as it might ping a backend. The sequence number keeps an older
+	// pong that took longer to build from replacing a newer one.
+	gateway.pongMu.Lock()
+	gateway.pongSeq++
+	seq := gateway.pongSeq
+	gateway.pongMu.Unlock()
+	data := gateway.marshalPong(addr, listener)
+
+	gateway.pongMu.Lock()
+	defer gateway.pongMu.Unlock()
+	cached := gateway.pongs[listener]
+	// Listeners closed while the pong was built must not be cached again
+	if v, ok := gateway.listeners.Load(addr); !ok || v != listener || seq < cached.seq {
+		return
+	}
+	if gateway.pongs == nil {
+		gateway.pongs = map[*raknet.Listener]cachedPong{}
+	}
+	gateway.pongs[listener] = cachedPong{seq: seq, data: data}
+	if !bytes.Equal(cached.data, data) {
+		listener.PongData(data)
+	}
+}
+
+// forgetPong removes the cached pong of a closed listener.
+func (gateway *Gateway) forgetPong(listener *raknet.Listener) {
+	gateway.pongMu.Lock()
+	delete(gateway.pongs, listener)
+	gateway.pongMu.Unlock()
+}
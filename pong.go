@@ -0,0 +1,196 @@
+package gamma
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PongModeStatic answers pings with the configured player count
+	PongModeStatic = "static"
+	// PongModeLive answers pings with the number of players connected to the listener
+	PongModeLive = "live"
+)
+
+// pong holds the server list information of an unconnected pong.
+type pong struct {
+	Edition         string
+	MOTD            string
+	ProtocolVersion int
+	VersionName     string
+	PlayerCount     int
+	MaxPlayerCount  int
+	SubMOTD         string
+	Gamemode        string
+	GamemodeNumeric int
+}
+
+// parsePong parses the pong data sent by a bedrock server, e.g.
+// MCPE;motd;560;1.19.50;0;10;serverID;subMotd;Survival;1;19132;19133;
+func parsePong(b []byte) (*pong, error) {
+	fields := strings.Split(string(b), ";")
+	if len(fields) < 6 {
+		return nil, errors.New("invalid pong data")
+	}
+	for len(fields) < 10 {
+		fields = append(fields, "")
+	}
+
+	p := &pong{
+		Edition:     fields[0],
+		MOTD:        fields[1],
+		VersionName: fields[3],
+		SubMOTD:     fields[7],
+		Gamemode:    fields[8],
+	}
+	p.ProtocolVersion, _ = strconv.Atoi(fields[2])
+	p.PlayerCount, _ = strconv.Atoi(fields[4])
+	p.MaxPlayerCount, _ = strconv.Atoi(fields[5])
+	p.GamemodeNumeric, _ = strconv.Atoi(fields[9])
+	return p, nil
+}
+
+// marshal encodes the pong for the listener l.
+func (p *pong) marshal(l *raknet.Listener) []byte {
+	port := l.Addr().(*net.UDPAddr).Port
+	return []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;",
+		p.Edition, p.MOTD, p.ProtocolVersion, p.VersionName, p.PlayerCount, p.MaxPlayerCount,
+		l.ID(), p.SubMOTD, p.Gamemode, p.GamemodeNumeric, port, port))
+}
+
+// UpdatePongData re-applies the pong data of every listener, e.g. after the global config was reloaded.
+func (gateway *Gateway) UpdatePongData() {
+	gateway.listeners.Range(func(k, v interface{}) bool {
+		gateway.updateListenerPong(k.(string))
+		return true
+	})
+}
+
+// refreshPongData periodically updates the pong data of every listener.
+func (gateway *Gateway) refreshPongData() {
+	done := gateway.doneChan()
+	for {
+		interval := time.Duration(GammaConfig().Ping.RefreshInterval) * time.Millisecond
+		if interval <= 0 {
+			interval = time.Duration(DefaultConfig.Ping.RefreshInterval) * time.Millisecond
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		// Keep answering pings from the cached pong while under attack instead of pinging backends
+		if gateway.UnderAttack() {
+			continue
+		}
+		gateway.UpdatePongData()
+	}
+}
+
+// listenerProxies returns the proxies registered on the listener addr, sorted by domain name.
+func (gateway *Gateway) listenerProxies(addr string) []*Proxy {
+	var proxies []*Proxy
+	seen := map[*Proxy]bool{}
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		proxy := v.(*Proxy)
+		if !seen[proxy] && proxy.ListenTo() == addr {
+			seen[proxy] = true
+			proxies = append(proxies, proxy)
+		}
+		return true
+	})
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].DomainName() < proxies[j].DomainName()
+	})
+	return proxies
+}
+
+// playerCount returns the online player count shown in the pong of the listener on addr.
+func (gateway *Gateway) playerCount(addr string, ping Ping) int {
+	if ping.Mode != PongModeLive {
+		return ping.PlayerCount
+	}
+
+	count := gateway.ListenerPlayers(addr) + ping.PlayerCountOffset
+	if ping.PlayerCountCap > 0 && count > ping.PlayerCountCap {
+		count = ping.PlayerCountCap
+	}
+	if count < 0 {
+		count = 0
+	}
+	return count
+}
+
+// pong builds the pong of the listener on addr. If one of its proxies has ping passthrough enabled the
+// status of that backend is relayed, otherwise the global ping config is used.
+func (gateway *Gateway) pong(addr string) *pong {
+	ping := GammaConfig().Ping
+	motd := strings.Split(ping.Description, "\n")
+	p := &pong{
+		Edition:         ping.Edition,
+		MOTD:            motd[0],
+		ProtocolVersion: ping.VersionProtocol,
+		VersionName:     ping.VersionName,
+		PlayerCount:     gateway.playerCount(addr, ping),
+		MaxPlayerCount:  ping.MaxPlayerCount,
+		Gamemode:        ping.Gamemode,
+		GamemodeNumeric: ping.GamemodeNumeric,
+	}
+	if len(motd) > 1 {
+		p.SubMOTD = motd[1]
+	}
+
+	proxies := gateway.listenerProxies(addr)
+	// The cap of a proxy is only meaningful in the pong if it is the only proxy on the listener
+	if len(proxies) == 1 && proxies[0].MaxPlayers() > 0 {
+		p.MaxPlayerCount = proxies[0].MaxPlayers()
+	}
+	if ping.MaintenanceDescription != "" && len(proxies) > 0 {
+		maintenance := true
+		for _, proxy := range proxies {
+			maintenance = maintenance && proxy.Maintenance()
+		}
+		if maintenance {
+			motd := strings.Split(ping.MaintenanceDescription, "\n")
+			p.MOTD = motd[0]
+			p.SubMOTD = ""
+			if len(motd) > 1 {
+				p.SubMOTD = motd[1]
+			}
+			return p
+		}
+	}
+
+	for _, proxy := range proxies {
+		if !proxy.PingPassthrough() {
+			continue
+		}
+
+		status, err := proxy.Status()
+		if err != nil {
+			if GammaConfig().Debug {
+				log.Printf("[i] Failed to ping %s; error: %s", proxy.ProxyTo(), err)
+			}
+			p.MOTD = proxy.OfflineMotd()
+			p.SubMOTD = ""
+			return p
+		}
+		relayed := *status
+		return &relayed
+	}
+
+	return p
+}
+
+func (gateway *Gateway) marshalPong(addr string, l *raknet.Listener) []byte {
+	return gateway.pong(addr).marshal(l)
+}
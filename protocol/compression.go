@@ -89,6 +89,33 @@ func (FlateCompression) Decompress(compressed []byte) ([]byte, error) {
 	return decompressed.Bytes(), nil
 }
 
+// DecompressLimit decompresses the given data, failing with ErrPacketTooLarge once the output exceeds limit.
+func (FlateCompression) DecompressLimit(compressed []byte, limit int) ([]byte, error) {
+	buf := bytes.NewReader(compressed)
+	c := flateDecompressPool.Get().(io.ReadCloser)
+	defer flateDecompressPool.Put(c)
+
+	if err := c.(flate.Resetter).Reset(buf, nil); err != nil {
+		return nil, fmt.Errorf("reset flate: %w", err)
+	}
+	_ = c.Close()
+
+	guess := len(compressed) * 2
+	if guess > limit {
+		guess = limit
+	}
+	decompressed := bytes.NewBuffer(make([]byte, 0, guess))
+	// Read one byte more than allowed to detect output that exceeds the limit
+	n, err := io.Copy(decompressed, io.LimitReader(c, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress flate: %v", err)
+	}
+	if n > int64(limit) {
+		return nil, fmt.Errorf("%w: decompressed data exceeds %v bytes", ErrPacketTooLarge, limit)
+	}
+	return decompressed.Bytes(), nil
+}
+
 // EncodeCompression ...
 func (SnappyCompression) EncodeCompression() uint16 {
 	return 1
@@ -115,6 +142,19 @@ func (SnappyCompression) Decompress(compressed []byte) ([]byte, error) {
 	return decompressed, nil
 }
 
+// DecompressLimit decompresses the given data, failing with ErrPacketTooLarge if the output would exceed
+// limit. The decoded length is checked before anything is allocated.
+func (SnappyCompression) DecompressLimit(compressed []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decompress snappy: %w", err)
+	}
+	if n > limit {
+		return nil, fmt.Errorf("%w: decompressed data exceeds %v bytes", ErrPacketTooLarge, limit)
+	}
+	return SnappyCompression{}.Decompress(compressed)
+}
+
 // init registers all valid compressions with the protocol.
 func init() {
 	RegisterCompression(FlateCompression{})
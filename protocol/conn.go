@@ -10,6 +10,8 @@ type ProcessedConn struct {
 	RemoteAddr   net.Addr
 	ServerAddr   string
 	Username     string
+	XUID         string
+	UUID         string
 	NetworkBytes []byte
 	ReadBytes    []byte
 }
@@ -13,59 +13,103 @@ const (
 	// maximumInBatch is the maximum amount of packets that may be found in a batch. If a compressed batch has
 	// more than this amount, decoding will fail.
 	maximumInBatch = 512 + 256
+	// DefaultMaxBatchSize is the maximum size of a batch before and after decompression, unless changed
+	// with SetMaxBatchSize.
+	DefaultMaxBatchSize = 1024 * 1024 * 3
 )
 
+// lenReader is implemented by readers that know how many bytes are left, such as bytes.Reader.
+type lenReader interface {
+	Len() int
+}
+
+// limitedDecompressor is implemented by compressions that can stop decompressing once the output exceeds
+// a limit, so that small compressed batches can't expand into huge allocations.
+type limitedDecompressor interface {
+	DecompressLimit(compressed []byte, limit int) ([]byte, error)
+}
+
 type Decoder struct {
 	// r holds the io.Reader that packets are read from if the reader does not implement packetReader. When
 	// this is the case, the buf field has a non-zero length.
-	r           io.Reader
-	buf         []byte
-	compression Compression
+	r            io.Reader
+	buf          []byte
+	compression  Compression
+	maxBatchSize int
 }
 
 // NewDecoder returns a new decoder decoding data from the io.Reader passed. One read call from the reader is
 // assumed to consume an entire packet.
 func NewDecoder(reader io.Reader) *Decoder {
 	return &Decoder{
-		r:   reader,
-		buf: make([]byte, 1024*1024*3),
+		r:            reader,
+		maxBatchSize: DefaultMaxBatchSize,
 	}
 }
 
+// SetMaxBatchSize sets the maximum size of a batch before and after decompression. Larger batches fail
+// to decode with ErrPacketTooLarge.
+func (decoder *Decoder) SetMaxBatchSize(n int) {
+	decoder.maxBatchSize = n
+	decoder.buf = nil
+}
+
 // Decode decodes one 'packet' from the io.Reader passed in NewDecoder(), producing a slice of packets that it
 // held and an error if not successful.
 func (decoder *Decoder) Decode() (packets [][]byte, err error) {
-	n, err := decoder.r.Read(decoder.buf)
+	// One byte more than allowed is read to detect batches that are too large. Readers that know their
+	// length only get a buffer of the size they hold.
+	buf := decoder.buf
+	if r, ok := decoder.r.(lenReader); ok && r.Len() < decoder.maxBatchSize {
+		buf = make([]byte, r.Len()+1)
+	} else if buf == nil {
+		decoder.buf = make([]byte, decoder.maxBatchSize+1)
+		buf = decoder.buf
+	}
+	n, err := decoder.r.Read(buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading batch from reader: %v", err)
 	}
-	data := decoder.buf[:n]
+	if n > decoder.maxBatchSize {
+		return nil, fmt.Errorf("%w: batch exceeds %v bytes", ErrPacketTooLarge, decoder.maxBatchSize)
+	}
+	data := buf[:n]
 
 	if len(data) == 0 {
 		return nil, nil
 	}
 	if data[0] != header {
-		return nil, fmt.Errorf("error reading packet: invalid packet header %x: expected %x", data[0], header)
+		return nil, fmt.Errorf("%w: invalid packet header %x: expected %x", ErrMalformedPacket, data[0], header)
 	}
 	data = data[1:]
 
 	if decoder.compression != nil {
-		data, err = decoder.compression.Decompress(data)
+		if c, ok := decoder.compression.(limitedDecompressor); ok {
+			data, err = c.DecompressLimit(data, decoder.maxBatchSize)
+		} else {
+			data, err = decoder.compression.Decompress(data)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error decompressing packet: %v", err)
+			return nil, fmt.Errorf("error decompressing packet: %w", err)
+		}
+		if len(data) > decoder.maxBatchSize {
+			return nil, fmt.Errorf("%w: decompressed batch exceeds %v bytes", ErrPacketTooLarge, decoder.maxBatchSize)
 		}
 	}
 	b := bytes.NewBuffer(data)
 	for b.Len() != 0 {
 		var length uint32
 		if err := Varuint32(b, &length); err != nil {
-			return nil, fmt.Errorf("error reading packet length: %v", err)
+			return nil, fmt.Errorf("%w: error reading packet length: %v", ErrMalformedPacket, err)
+		}
+		if int64(length) > int64(b.Len()) {
+			return nil, fmt.Errorf("%w: packet length %v exceeds the %v remaining bytes", ErrMalformedPacket, length, b.Len())
+		}
+		if len(packets) == maximumInBatch {
+			return nil, fmt.Errorf("%w: number of packets in compressed batch exceeds %v", ErrTooManyPackets, maximumInBatch)
 		}
 		packets = append(packets, b.Next(int(length)))
 	}
-	if len(packets) > maximumInBatch {
-		return nil, fmt.Errorf("number of packets %v in compressed batch exceeds %v", len(packets), maximumInBatch)
-	}
 	return packets, nil
 }
 
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// varuint encodes x like Varuint32 reads it.
+func varuint(x uint32) []byte {
+	var b []byte
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+// batch encodes the packets into a batch compressed with c, or an uncompressed batch if c is nil.
+func batch(t testing.TB, c Compression, packets ...[]byte) []byte {
+	t.Helper()
+	var data []byte
+	for _, pk := range packets {
+		data = append(data, varuint(uint32(len(pk)))...)
+		data = append(data, pk...)
+	}
+	if c != nil {
+		var err error
+		if data, err = c.Compress(data); err != nil {
+			t.Fatal(err)
+		}
+		data = append([]byte(nil), data...)
+	}
+	return append([]byte{header}, data...)
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		compression  Compression
+		maxBatchSize int
+		data         []byte
+		want         error
+	}{
+		{"batch too large", nil, 16, batch(t, nil, make([]byte, 32)), ErrPacketTooLarge},
+		{"flate batch too large after decompression", FlateCompression{}, 64, batch(t, FlateCompression{}, make([]byte, 1024)), ErrPacketTooLarge},
+		{"snappy batch too large after decompression", SnappyCompression{}, 64, batch(t, SnappyCompression{}, make([]byte, 1024)), ErrPacketTooLarge},
+		{"oversized packet length", nil, DefaultMaxBatchSize, append([]byte{header}, varuint(0xffffffff)...), ErrMalformedPacket},
+		{"too many packets", nil, DefaultMaxBatchSize, batch(t, nil, make([][]byte, maximumInBatch+1)...), ErrTooManyPackets},
+		{"invalid header", nil, DefaultMaxBatchSize, []byte{0x01, 0x00}, ErrMalformedPacket},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewDecoder(bytes.NewReader(test.data))
+			if test.compression != nil {
+				decoder.EnableCompression(test.compression)
+			}
+			decoder.SetMaxBatchSize(test.maxBatchSize)
+			if _, err := decoder.Decode(); !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, c := range []Compression{nil, FlateCompression{}, SnappyCompression{}} {
+		decoder := NewDecoder(bytes.NewReader(batch(t, c, []byte("first"), []byte("second"))))
+		if c != nil {
+			decoder.EnableCompression(c)
+		}
+		packets, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("decode %T batch: %v", c, err)
+		}
+		if len(packets) != 2 || string(packets[0]) != "first" || string(packets[1]) != "second" {
+			t.Errorf("decoded %T batch into %q", c, packets)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(batch(f, FlateCompression{}, []byte{0x01, 0x02, 0x03}))
+	f.Add(batch(f, FlateCompression{}, make([]byte, 4096)))
+	f.Add(append([]byte{header}, varuint(0xffffffff)...))
+	f.Add([]byte{header, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	f.Add(batch(f, FlateCompression{}, varuint(0xffffffff)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const maxBatchSize = 64 * 1024
+		for _, c := range []Compression{nil, FlateCompression{}, SnappyCompression{}} {
+			decoder := NewDecoder(bytes.NewReader(data))
+			if c != nil {
+				decoder.EnableCompression(c)
+			}
+			decoder.SetMaxBatchSize(maxBatchSize)
+			packets, err := decoder.Decode()
+			if err != nil {
+				continue
+			}
+			if len(packets) > maximumInBatch {
+				t.Errorf("decoded %v packets, the limit is %v", len(packets), maximumInBatch)
+			}
+			total := 0
+			for _, pk := range packets {
+				total += len(pk)
+			}
+			if total > maxBatchSize {
+				t.Errorf("decoded %v bytes of packets, the limit is %v", total, maxBatchSize)
+			}
+		}
+	})
+}
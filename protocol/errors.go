@@ -0,0 +1,14 @@
+package protocol
+
+import "errors"
+
+// The errors returned for input that exceeds a limit or can't be decoded. They are wrapped with details,
+// use errors.Is to check for them.
+var (
+	// ErrPacketTooLarge is returned for batches and byte slices that are larger than allowed
+	ErrPacketTooLarge = errors.New("packet too large")
+	// ErrTooManyPackets is returned for batches with more than maximumInBatch packets
+	ErrTooManyPackets = errors.New("too many packets in batch")
+	// ErrMalformedPacket is returned for packets that are truncated or otherwise invalid
+	ErrMalformedPacket = errors.New("malformed packet")
+)
@@ -8,6 +8,12 @@ type IdentityData struct {
 	// DisplayName is the username of the player, which may be changed by the user. It should for that reason
 	// not be used as a key to store information.
 	DisplayName string `json:"displayName"`
+	// XUID is the XBOX Live user ID of the player, which will remain consistent as long as the player is
+	// logged in with the XBOX Live account. It is empty if the user is not logged into its XBL account.
+	XUID string `json:"XUID"`
+	// Identity is the UUID of the player, which is derived from its XUID by Mojang. It is self-signed, and
+	// thus chosen by the client, if the player is not logged into XBOX Live.
+	Identity string `json:"identity"`
 }
 
 // ClientData is a container of client specific data of a Login packet. It holds data such as the skin of a
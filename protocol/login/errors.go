@@ -0,0 +1,16 @@
+package login
+
+import "errors"
+
+// The errors returned for login requests that exceed the Limits or can't be decoded. They are wrapped with
+// details, use errors.Is to check for them.
+var (
+	// ErrChainTooLarge is returned for chains larger than Limits.MaxChainSize
+	ErrChainTooLarge = errors.New("login chain too large")
+	// ErrTokenTooLarge is returned for tokens larger than Limits.MaxTokenSize
+	ErrTokenTooLarge = errors.New("login token too large")
+	// ErrMalformedRequest is returned for login requests that are truncated or otherwise invalid
+	ErrMalformedRequest = errors.New("malformed login request")
+	// ErrInvalidChain is returned for chains with an invalid or expired token
+	ErrInvalidChain = errors.New("invalid login chain")
+)
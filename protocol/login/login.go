@@ -2,9 +2,11 @@ package login
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -22,90 +24,166 @@ type request struct {
 	RawToken string `json:"-"`
 }
 
-func Parse(request []byte) (IdentityData, ClientData, error) {
-	req, err := parseLoginRequest(request)
+// Limits caps the sizes of the parts of a login request.
+type Limits struct {
+	// MaxChainSize is the maximum size of the JSON encoded chain in bytes
+	MaxChainSize int
+	// MaxTokenSize is the maximum size of a single token in bytes, including the client data token
+	MaxTokenSize int
+}
+
+// DefaultLimits are the limits used by Parse. Chains of real clients are a few kilobytes, the client data
+// token holds the skin of the player and is much larger.
+var DefaultLimits = Limits{
+	MaxChainSize: 64 * 1024,
+	MaxTokenSize: 2 * 1024 * 1024,
+}
+
+// AuthResult is returned by a call to Parse. It holds the result of the verification of the login chain.
+type AuthResult struct {
+	// PublicKey is the public key of the client, which signed the ClientData.
+	PublicKey *ecdsa.PublicKey
+	// XBOXLiveAuthenticated is true if the chain was signed by Mojang, meaning the player is logged into
+	// XBOX Live and the IdentityData can be trusted.
+	XBOXLiveAuthenticated bool
+}
+
+// Parse parses and verifies the login request passed. Every token in the chain must be signed with ES384
+// by the identityPublicKey of the token before it, the first token by the key in its x5u header, and none
+// of the tokens may be expired. The player is authenticated if the chain is rooted at the Mojang public
+// key. The XUID of unauthenticated players can't be trusted and is left empty.
+func Parse(request []byte) (IdentityData, ClientData, AuthResult, error) {
+	return ParseWithLimits(request, DefaultLimits)
+}
+
+// ParseWithLimits parses and verifies the login request like Parse, rejecting chains and tokens that
+// exceed limits before they are decoded.
+func ParseWithLimits(request []byte, limits Limits) (IdentityData, ClientData, AuthResult, error) {
+	req, err := parseLoginRequest(request, limits)
 	if err != nil {
-		return IdentityData{}, ClientData{}, fmt.Errorf("parse login request: %w", err)
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse login request: %w", err)
+	}
+
+	now := time.Now()
+	key, err := x5uKey(req.Chain[0])
+	if err != nil {
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse token 0: %w", err)
 	}
 
-	jwtParser := jwt.Parser{}
 	var identityClaims identityClaims
+	var authenticated bool
 	switch len(req.Chain) {
 	case 1:
 		// Player was not authenticated with XBOX Live, meaning the one token in here is self-signed.
-		_, _, err = jwtParser.ParseUnverified(req.Chain[2], &identityClaims)
-		if err != nil {
-			return IdentityData{}, ClientData{}, err
-		}
-		if err := identityClaims.Valid(); err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("validate token 0: %w", err)
+		if err := verify(req.Chain[0], key, &identityClaims, now); err != nil {
+			return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("verify token 0: %w", err)
 		}
 	case 3:
 		// Player was (or should be) authenticated with XBOX Live, meaning the chain is exactly 3 tokens
-		// long.
-		var c jwt.RegisteredClaims
-		_, _, err := jwtParser.ParseUnverified(req.Chain[0], &c)
-		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 0: %w", err)
-		}
-
-		_, _, err = jwtParser.ParseUnverified(req.Chain[1], &c)
-		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 1: %w", err)
+		// long. The first token is self-signed and hands over to the Mojang key if the player is logged in.
+		for i, token := range req.Chain[:2] {
+			var c chainClaims
+			if err := verify(token, key, &c, now); err != nil {
+				return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("verify token %v: %w", i, err)
+			}
+			if i == 0 {
+				authenticated = isMojangKey(c.IdentityPublicKey)
+			}
+			if key, err = parsePublicKey(c.IdentityPublicKey); err != nil {
+				return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse identityPublicKey of token %v: %w", i, err)
+			}
 		}
-		_, _, err = jwtParser.ParseUnverified(req.Chain[2], &identityClaims)
-		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 2: %w", err)
+		if err := verify(req.Chain[2], key, &identityClaims, now); err != nil {
+			return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("verify token 2: %w", err)
 		}
 	default:
-		return IdentityData{}, ClientData{}, fmt.Errorf("unexpected login chain length %v", len(req.Chain))
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("%w: unexpected login chain length %v", ErrMalformedRequest, len(req.Chain))
 	}
 
-	var cData ClientData
-	_, _, err = jwtParser.ParseUnverified(req.RawToken, &cData)
+	// The client data is signed by the key of the client, which is the identityPublicKey of the last token.
+	clientKey, err := parsePublicKey(identityClaims.IdentityPublicKey)
 	if err != nil {
-		return IdentityData{}, cData, fmt.Errorf("parse client data: %w", err)
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse identityPublicKey of token %v: %w", len(req.Chain)-1, err)
+	}
+	var cData ClientData
+	if err := verify(req.RawToken, clientKey, &cData, now); err != nil {
+		return IdentityData{}, cData, AuthResult{}, fmt.Errorf("verify client data: %w", err)
 	}
 
-	return identityClaims.ExtraData, cData, nil
+	iData := identityClaims.ExtraData
+	if !authenticated {
+		iData.XUID = ""
+	}
+	return iData, cData, AuthResult{PublicKey: clientKey, XBOXLiveAuthenticated: authenticated}, nil
 }
 
 // parseLoginRequest parses the structure of a login request from the data passed and returns it.
-func parseLoginRequest(requestData []byte) (*request, error) {
+func parseLoginRequest(requestData []byte, limits Limits) (*request, error) {
 	buf := bytes.NewBuffer(requestData)
-	chain, err := decodeChain(buf)
+	chain, err := decodeChain(buf, limits)
 	if err != nil {
 		return nil, err
 	}
 	if len(chain) < 1 {
-		return nil, fmt.Errorf("JWT chain must be at least 1 token long")
+		return nil, fmt.Errorf("%w: JWT chain must be at least 1 token long", ErrMalformedRequest)
+	}
+	for i, token := range chain {
+		if len(token) > limits.MaxTokenSize {
+			return nil, fmt.Errorf("%w: token %v is %v bytes long", ErrTokenTooLarge, i, len(token))
+		}
+	}
+	rawLength, err := readLength(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading raw token length: %w", err)
+	}
+	if rawLength > limits.MaxTokenSize {
+		return nil, fmt.Errorf("%w: raw token is %v bytes long", ErrTokenTooLarge, rawLength)
+	}
+	return &request{Chain: chain, RawToken: string(buf.Next(rawLength))}, nil
+}
+
+// readLength reads a little endian int32 length prefix, which must not be negative or exceed the
+// remaining bytes of buf.
+func readLength(buf *bytes.Buffer) (int, error) {
+	var length int32
+	if err := binary.Read(buf, binary.LittleEndian, &length); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
-	var rawLength int32
-	if err := binary.Read(buf, binary.LittleEndian, &rawLength); err != nil {
-		return nil, fmt.Errorf("error reading raw token length: %v", err)
+	if length < 0 || int(length) > buf.Len() {
+		return 0, fmt.Errorf("%w: length %v exceeds the %v remaining bytes", ErrMalformedRequest, length, buf.Len())
 	}
-	return &request{Chain: chain, RawToken: string(buf.Next(int(rawLength)))}, nil
+	return int(length), nil
 }
 
 // decodeChain reads a certificate chain from the buffer passed and returns each claim found in the chain.
-func decodeChain(buf *bytes.Buffer) (chain, error) {
-	var chainLength int32
-	if err := binary.Read(buf, binary.LittleEndian, &chainLength); err != nil {
-		return nil, fmt.Errorf("error reading chain length: %v", err)
+func decodeChain(buf *bytes.Buffer, limits Limits) (chain, error) {
+	chainLength, err := readLength(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chain length: %w", err)
 	}
-	chainData := buf.Next(int(chainLength))
+	if chainLength > limits.MaxChainSize {
+		return nil, fmt.Errorf("%w: chain is %v bytes long", ErrChainTooLarge, chainLength)
+	}
+	chainData := buf.Next(chainLength)
 
 	request := &request{}
 	if err := json.Unmarshal(chainData, request); err != nil {
-		return nil, fmt.Errorf("error decoding request chain JSON: %v", err)
+		return nil, fmt.Errorf("%w: error decoding request chain JSON: %v", ErrMalformedRequest, err)
 	}
 	// First check if the chain actually has any elements in it.
 	if len(request.Chain) == 0 {
-		return nil, fmt.Errorf("connection request had no claims in the chain")
+		return nil, fmt.Errorf("%w: connection request had no claims in the chain", ErrMalformedRequest)
 	}
 	return request.Chain, nil
 }
 
+// chainClaims holds the claims of the tokens in the chain before the last one.
+type chainClaims struct {
+	jwt.RegisteredClaims
+
+	IdentityPublicKey string `json:"identityPublicKey"`
+}
+
 // identityClaims holds the claims for the last token in the chain, which contains the IdentityData of the
 // player.
 type identityClaims struct {
@@ -0,0 +1,311 @@
+package login
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testKey is a generated P-384 key that signs the tokens of a test chain.
+type testKey struct {
+	priv *ecdsa.PrivateKey
+	// pub is the base64 encoded DER public key, as found in x5u headers and identityPublicKey claims
+	pub string
+}
+
+func newTestKey(t testing.TB) testKey {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{priv: priv, pub: base64.StdEncoding.EncodeToString(der)}
+}
+
+// sign returns a token with the claims signed by the key, its public key is set as x5u header.
+func (key testKey) sign(t testing.TB, claims jwt.MapClaims) string {
+	return key.signWithX5U(t, key.pub, claims)
+}
+
+func (key testKey) signWithX5U(t testing.TB, x5u string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES384, claims)
+	token.Header["x5u"] = x5u
+	s, err := token.SignedString(key.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testClaims returns claims that are valid from now until an hour from now.
+func testClaims(extra jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"nbf": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+// identityToken returns the last token of a chain, which is signed by signer and hands over to client.
+func identityToken(t testing.TB, signer, client testKey) string {
+	return signer.sign(t, testClaims(jwt.MapClaims{
+		"identityPublicKey": client.pub,
+		"extraData": jwt.MapClaims{
+			"displayName": "Steve",
+			"XUID":        "2535405290765612",
+			"identity":    "d6d6ba6a-5a7e-3a2b-9f5f-7e7a3a1b2c3d",
+		},
+	}))
+}
+
+// clientDataToken returns a client data token signed by key.
+func clientDataToken(t testing.TB, key testKey) string {
+	return key.sign(t, testClaims(jwt.MapClaims{"ServerAddress": "play.example.com:19132"}))
+}
+
+// threeTokenChain returns a chain like the one of an XBOX Live authenticated client, rooted at root.
+func threeTokenChain(t testing.TB, client, root testKey) []string {
+	intermediate := newTestKey(t)
+	return []string{
+		client.sign(t, testClaims(jwt.MapClaims{"identityPublicKey": root.pub})),
+		root.sign(t, testClaims(jwt.MapClaims{"identityPublicKey": intermediate.pub})),
+		identityToken(t, intermediate, client),
+	}
+}
+
+// encodeRequest encodes the chain and the client data token like the connection request of a login packet.
+func encodeRequest(t testing.TB, chain []string, rawToken string) []byte {
+	t.Helper()
+	chainData, err := json.Marshal(map[string][]string{"chain": chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, int32(len(chainData)))
+	buf.Write(chainData)
+	_ = binary.Write(buf, binary.LittleEndian, int32(len(rawToken)))
+	buf.WriteString(rawToken)
+	return buf.Bytes()
+}
+
+func TestParseSelfSigned(t *testing.T) {
+	client := newTestKey(t)
+	request := encodeRequest(t, []string{identityToken(t, client, client)}, clientDataToken(t, client))
+
+	iData, cData, auth, err := Parse(request)
+	if err != nil {
+		t.Fatalf("parse self-signed chain: %v", err)
+	}
+	if auth.XBOXLiveAuthenticated {
+		t.Error("self-signed chain is authenticated")
+	}
+	if !auth.PublicKey.Equal(&client.priv.PublicKey) {
+		t.Error("public key is not the key of the client")
+	}
+	if iData.DisplayName != "Steve" {
+		t.Errorf("display name is %q, want Steve", iData.DisplayName)
+	}
+	if iData.XUID != "" {
+		t.Errorf("XUID of an unauthenticated player is %q, want it empty", iData.XUID)
+	}
+	if cData.ServerAddress != "play.example.com:19132" {
+		t.Errorf("server address is %q", cData.ServerAddress)
+	}
+}
+
+func TestParseUntrustedRoot(t *testing.T) {
+	client := newTestKey(t)
+	request := encodeRequest(t, threeTokenChain(t, client, newTestKey(t)), clientDataToken(t, client))
+
+	iData, _, auth, err := Parse(request)
+	if err != nil {
+		t.Fatalf("parse chain with untrusted root: %v", err)
+	}
+	if auth.XBOXLiveAuthenticated {
+		t.Error("chain with a root other than the Mojang key is authenticated")
+	}
+	if iData.XUID != "" {
+		t.Errorf("XUID of an unauthenticated player is %q, want it empty", iData.XUID)
+	}
+}
+
+func TestParseTrustedRoot(t *testing.T) {
+	root := newTestKey(t)
+	keys := mojangPublicKeys
+	mojangPublicKeys = append([]string{root.pub}, keys...)
+	defer func() {
+		mojangPublicKeys = keys
+	}()
+
+	client := newTestKey(t)
+	request := encodeRequest(t, threeTokenChain(t, client, root), clientDataToken(t, client))
+
+	iData, _, auth, err := Parse(request)
+	if err != nil {
+		t.Fatalf("parse chain with trusted root: %v", err)
+	}
+	if !auth.XBOXLiveAuthenticated {
+		t.Error("chain with a trusted root is not authenticated")
+	}
+	if iData.XUID != "2535405290765612" {
+		t.Errorf("XUID is %q, want 2535405290765612", iData.XUID)
+	}
+}
+
+func TestParseInvalidChain(t *testing.T) {
+	client, other := newTestKey(t), newTestKey(t)
+
+	// The x5u header names the key of the client, but the token is signed by another key
+	wrongKey := other.signWithX5U(t, client.pub, testClaims(jwt.MapClaims{"identityPublicKey": client.pub}))
+
+	expired := client.sign(t, jwt.MapClaims{
+		"identityPublicKey": client.pub,
+		"exp":               time.Now().Add(-time.Hour).Unix(),
+	})
+
+	brokenRoot := threeTokenChain(t, client, newTestKey(t))
+	brokenRoot[1] = other.sign(t, testClaims(jwt.MapClaims{"identityPublicKey": client.pub}))
+
+	tests := []struct {
+		name     string
+		chain    []string
+		rawToken string
+	}{
+		{"wrong signing key", []string{wrongKey}, clientDataToken(t, client)},
+		{"expired token", []string{expired}, clientDataToken(t, client)},
+		{"broken chain", brokenRoot, clientDataToken(t, client)},
+		{"client data signed by another key", []string{identityToken(t, client, client)}, clientDataToken(t, other)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := Parse(encodeRequest(t, test.chain, test.rawToken))
+			if !errors.Is(err, ErrInvalidChain) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidChain)
+			}
+		})
+	}
+}
+
+func TestParseClientDataBadSignature(t *testing.T) {
+	client := newTestKey(t)
+	rawToken := clientDataToken(t, client)
+	// Replace a character of the signature, the token stays well-formed
+	i := len(rawToken) - 10
+	replacement := "A"
+	if rawToken[i] == 'A' {
+		replacement = "B"
+	}
+	rawToken = rawToken[:i] + replacement + rawToken[i+1:]
+
+	_, _, _, err := Parse(encodeRequest(t, []string{identityToken(t, client, client)}, rawToken))
+	if !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidChain)
+	}
+}
+
+// TestParseChainLengths covers chains that are neither 1 nor 3 tokens long, and single token chains that
+// used to be read at index 2.
+func TestParseChainLengths(t *testing.T) {
+	client := newTestKey(t)
+	token := identityToken(t, client, client)
+
+	tests := []struct {
+		name  string
+		chain []string
+		want  error
+	}{
+		{"single invalid token", []string{"invalid"}, ErrInvalidChain},
+		{"two tokens", []string{token, token}, ErrMalformedRequest},
+		{"four tokens", []string{token, token, token, token}, ErrMalformedRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := Parse(encodeRequest(t, test.chain, clientDataToken(t, client)))
+			if !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// lengthPrefixed encodes a request with the given chain and raw token length prefixes, followed by data.
+func lengthPrefixed(chainLength, rawLength int32, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, chainLength)
+	buf.Write(data)
+	_ = binary.Write(buf, binary.LittleEndian, rawLength)
+	return buf.Bytes()
+}
+
+func TestParseLimits(t *testing.T) {
+	client := newTestKey(t)
+	token := identityToken(t, client, client)
+	limits := Limits{MaxChainSize: 4096, MaxTokenSize: 2048}
+
+	chainData, _ := json.Marshal(map[string][]string{"chain": {token}})
+	largeChain, _ := json.Marshal(map[string][]string{"chain": {strings.Repeat("a", 8192)}})
+
+	tests := []struct {
+		name    string
+		request []byte
+		want    error
+	}{
+		{"chain too large", lengthPrefixed(int32(len(largeChain)), 0, largeChain), ErrChainTooLarge},
+		{"token too large", encodeRequest(t, []string{token + strings.Repeat("a", 2048)}, ""), ErrTokenTooLarge},
+		{"raw token too large", encodeRequest(t, []string{token}, strings.Repeat("a", 4096)), ErrTokenTooLarge},
+		{"chain length beyond the request", lengthPrefixed(1<<30, 0, chainData), ErrMalformedRequest},
+		{"negative chain length", lengthPrefixed(-1, 0, chainData), ErrMalformedRequest},
+		{"raw token length beyond the request", append(lengthPrefixed(int32(len(chainData)), 1<<30, chainData), 'a'), ErrMalformedRequest},
+		{"negative raw token length", lengthPrefixed(int32(len(chainData)), -1, chainData), ErrMalformedRequest},
+		{"truncated request", []byte{0x01, 0x00}, ErrMalformedRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := ParseWithLimits(test.request, limits); !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	client := newTestKey(f)
+	chainData, _ := json.Marshal(map[string][]string{"chain": {identityToken(f, client, client)}})
+	f.Add(encodeRequest(f, []string{identityToken(f, client, client)}, clientDataToken(f, client)))
+	f.Add(encodeRequest(f, threeTokenChain(f, client, newTestKey(f)), clientDataToken(f, client)))
+	f.Add(lengthPrefixed(0x7fffffff, 0, chainData))
+	f.Add(lengthPrefixed(-1, 0, chainData))
+	f.Add(lengthPrefixed(int32(len(chainData)), 0x7fffffff, chainData))
+	f.Add(lengthPrefixed(int32(len(chainData)), -0x80000000, chainData))
+	f.Add([]byte(`{"chain":[]}`))
+
+	f.Fuzz(func(t *testing.T, request []byte) {
+		iData, _, auth, err := ParseWithLimits(request, Limits{MaxChainSize: 16 * 1024, MaxTokenSize: 16 * 1024})
+		if err != nil {
+			return
+		}
+		if !auth.XBOXLiveAuthenticated && iData.XUID != "" {
+			t.Errorf("unauthenticated request has XUID %q", iData.XUID)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package login
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mojangPublicKeys are the public keys that Mojang signs the login chains of XBOX Live authenticated players
+// with. This is the root key Mojang has used since 2021, the retired root from before is not trusted as
+// current clients are no longer signed by it and it would still grant XBOX Live authentication.
+var mojangPublicKeys = []string{
+	"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAECRXueJeTDqNRRgJi/vlRufByu/2G0i2Ebt6YMar5QX/R0DIIyrJMcUpruK4QveTfJSTp3Shlq4Gk34cD/4GUWwkv0DVuzeuB+tXija7HBxii03NHDbPAD0AKnLr2wdAp",
+}
+
+func init() {
+	for _, key := range mojangPublicKeys {
+		if _, err := parsePublicKey(key); err != nil {
+			panic(fmt.Errorf("parse mojang public key: %w", err))
+		}
+	}
+}
+
+// clockSkew is the difference in time allowed between the clocks of the client, Mojang and the gateway
+const clockSkew = time.Minute
+
+// timedClaims are claims that can be checked for expiry, which all claims embedding jwt.RegisteredClaims are.
+type timedClaims interface {
+	jwt.Claims
+	VerifyExpiresAt(cmp time.Time, req bool) bool
+	VerifyNotBefore(cmp time.Time, req bool) bool
+}
+
+// verify parses the token into claims after checking that it is signed with ES384 by key and is valid at now.
+func verify(token string, key *ecdsa.PublicKey, claims timedClaims, now time.Time) error {
+	parser := jwt.Parser{ValidMethods: []string{jwt.SigningMethodES384.Alg()}, SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidChain, err)
+	}
+	if !claims.VerifyExpiresAt(now.Add(-clockSkew), false) {
+		return fmt.Errorf("%w: token is expired", ErrInvalidChain)
+	}
+	if !claims.VerifyNotBefore(now.Add(clockSkew), false) {
+		return fmt.Errorf("%w: token is not valid yet", ErrInvalidChain)
+	}
+	return nil
+}
+
+// x5uKey returns the public key in the x5u header of the token, which the first token of a chain is
+// signed with.
+func x5uKey(token string) (*ecdsa.PublicKey, error) {
+	t, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidChain, err)
+	}
+	x5u, ok := t.Header["x5u"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing x5u header", ErrInvalidChain)
+	}
+	return parsePublicKey(x5u)
+}
+
+// parsePublicKey parses a base64 encoded DER public key as found in the x5u header and the
+// identityPublicKey claim. Only P-384 keys are accepted.
+func parsePublicKey(s string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode public key: %v", ErrInvalidChain, err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse public key: %v", ErrInvalidChain, err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P384() {
+		return nil, fmt.Errorf("%w: public key is not an ECDSA P-384 key", ErrInvalidChain)
+	}
+	return key, nil
+}
+
+func isMojangKey(s string) bool {
+	for _, key := range mojangPublicKeys {
+		if s == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// loginPacket encodes a Login packet with a connection request of the given length prefix and data.
+func loginPacket(length uint32, request []byte) []byte {
+	b := varuint((&Login{}).ID())
+	protocol := make([]byte, 4)
+	binary.BigEndian.PutUint32(protocol, 594)
+	b = append(b, protocol...)
+	b = append(b, varuint(length)...)
+	return append(b, request...)
+}
+
+func TestUnmarshalLoginLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"oversized request length", loginPacket(0xffffffff, nil), ErrPacketTooLarge},
+		{"request length above the limit", loginPacket(DefaultMaxByteSliceSize+1, nil), ErrPacketTooLarge},
+		{"request length beyond the packet", loginPacket(1024, make([]byte, 16)), ErrMalformedPacket},
+		{"truncated protocol", varuint((&Login{}).ID()), ErrMalformedPacket},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pk Login
+			if err := UnmarshalPacket(test.data, &pk); !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLogin(t *testing.T) {
+	var pk Login
+	if err := UnmarshalPacket(loginPacket(5, []byte("hello")), &pk); err != nil {
+		t.Fatalf("unmarshal login: %v", err)
+	}
+	if pk.ClientProtocol != 594 || string(pk.ConnectionRequest) != "hello" {
+		t.Errorf("unmarshalled %+v", pk)
+	}
+}
+
+func FuzzUnmarshalPacket(f *testing.F) {
+	f.Add(loginPacket(5, []byte("hello")))
+	f.Add(loginPacket(0xffffffff, nil))
+	f.Add(loginPacket(0x7fffffff, make([]byte, 16)))
+	f.Add(append(varuint((&RequestNetworkSettings{}).ID()), 0x00, 0x00, 0x02, 0x52))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var login Login
+		if err := UnmarshalPacket(data, &login); err == nil && len(login.ConnectionRequest) > len(data) {
+			t.Errorf("connection request of %v bytes decoded from %v bytes", len(login.ConnectionRequest), len(data))
+		}
+		var settings RequestNetworkSettings
+		_ = UnmarshalPacket(data, &settings)
+	})
+}
@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -11,18 +12,29 @@ type DecodeReader interface {
 	io.ByteReader
 }
 
+// DefaultMaxByteSliceSize is the maximum length of a byte slice read by a Reader, unless changed with
+// SetMaxByteSliceSize.
+const DefaultMaxByteSliceSize = 1024 * 1024 * 3
+
 type Reader struct {
 	DecodeReader
+	maxByteSliceSize int
 }
 
 func NewReader(r DecodeReader) *Reader {
-	return &Reader{DecodeReader: r}
+	return &Reader{DecodeReader: r, maxByteSliceSize: DefaultMaxByteSliceSize}
+}
+
+// SetMaxByteSliceSize sets the maximum length of the byte slices read, longer slices fail with
+// ErrPacketTooLarge.
+func (r *Reader) SetMaxByteSliceSize(n int) {
+	r.maxByteSliceSize = n
 }
 
 func (r *Reader) BEInt32(x *int32) error {
 	b := make([]byte, 4)
-	if _, err := r.Read(b); err != nil {
-		return err
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedPacket, err)
 	}
 	*x = int32(binary.BigEndian.Uint32(b))
 	return nil
@@ -30,15 +42,19 @@ func (r *Reader) BEInt32(x *int32) error {
 
 func (r *Reader) ByteSlice(x *[]byte) error {
 	var length uint32
-	r.Varuint32(&length)
-	l := int(length)
-	int32max := 1<<31 - 1
-	if l > int32max {
-		return errors.New("byte slice overflows int32")
+	if err := r.Varuint32(&length); err != nil {
+		return fmt.Errorf("%w: error reading byte slice length: %v", ErrMalformedPacket, err)
+	}
+	if int64(length) > int64(r.maxByteSliceSize) {
+		return fmt.Errorf("%w: byte slice of %v bytes exceeds %v", ErrPacketTooLarge, length, r.maxByteSliceSize)
+	}
+	// Don't allocate more than the reader holds, the slice would be truncated anyway
+	if lr, ok := r.DecodeReader.(lenReader); ok && int64(length) > int64(lr.Len()) {
+		return fmt.Errorf("%w: byte slice of %v bytes exceeds the %v remaining bytes", ErrMalformedPacket, length, lr.Len())
 	}
-	data := make([]byte, l)
-	if _, err := r.Read(data); err != nil {
-		return err
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedPacket, err)
 	}
 	*x = data
 	return nil
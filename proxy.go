@@ -11,6 +11,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +20,10 @@ var (
 		Name: "gamma_connected",
 		Help: "The total number of connected players",
 	}, []string{"host"})
+	backendPlayersConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gamma_backend_connected",
+		Help: "The total number of connected players per backend",
+	}, []string{"host", "backend"})
 )
 
 type Proxy struct {
@@ -26,6 +31,45 @@ type Proxy struct {
 	UID    string
 	mu     sync.Mutex
 	Dialer raknet.Dialer
+
+	status       *pong
+	statusErr    error
+	statusExpiry time.Time
+
+	backendsMu     sync.Mutex
+	backends       []*Backend
+	fallbacks      []*Backend
+	backendsSynced bool
+	roundRobin     uint32
+	healthDone     chan struct{}
+
+	// players is the number of players that hold a slot of the proxy
+	players int32
+
+	// accessMu guards the access lists parsed from the config when the proxy is registered. accessErr
+	// holds the parse error of invalid lists, which reject every player.
+	accessMu  sync.RWMutex
+	allow     ipNetList
+	deny      ipNetList
+	accessErr error
+
+	events *eventBus
+}
+
+// NewProxy returns a proxy for cfg that dials its backends from the configured proxyBind.
+func NewProxy(name string, cfg *ProxyConfig) *Proxy {
+	return &Proxy{
+		Config: cfg,
+		UID:    name,
+		Dialer: raknet.Dialer{
+			UpstreamDialer: &net.Dialer{
+				Timeout: 5 * time.Second,
+				LocalAddr: &net.UDPAddr{
+					IP: net.ParseIP(cfg.ProxyBind),
+				},
+			},
+		},
+	}
 }
 
 func (proxy *Proxy) DomainNames() []string {
@@ -76,6 +120,117 @@ func (proxy *Proxy) ProxyBind() string {
 	return proxy.Config.ProxyBind
 }
 
+func (proxy *Proxy) PingPassthrough() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.PingPassthrough
+}
+
+func (proxy *Proxy) PingCacheTTL() time.Duration {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return time.Duration(proxy.Config.PingCacheTTL) * time.Millisecond
+}
+
+func (proxy *Proxy) OfflineMotd() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.OfflineMotd
+}
+
+func (proxy *Proxy) Maintenance() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.Maintenance
+}
+
+func (proxy *Proxy) MaintenanceMessage() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.MaintenanceMessage
+}
+
+// OnlineMode reports whether players have to be authenticated with XBOX Live to join the proxy.
+func (proxy *Proxy) OnlineMode() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.OnlineMode
+}
+
+func (proxy *Proxy) OnlineModeMessage() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.OnlineModeMessage
+}
+
+// MaxPlayers returns the maximum number of players of the proxy, 0 means there is no limit.
+func (proxy *Proxy) MaxPlayers() int {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.MaxPlayers
+}
+
+func (proxy *Proxy) FullMessage() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.FullMessage
+}
+
+// Players returns the number of players connected to the proxy.
+func (proxy *Proxy) Players() int {
+	return int(atomic.LoadInt32(&proxy.players))
+}
+
+// reserveSlot takes a player slot of the proxy, it returns false if the proxy is full. Players with an
+// XUID in the full bypass list always get a slot. The check and the increment happen atomically, so that
+// concurrent logins can't exceed the limit.
+func (proxy *Proxy) reserveSlot(xuid string) bool {
+	proxy.Config.RLock()
+	max := int32(proxy.Config.MaxPlayers)
+	bypass := false
+	for _, entry := range proxy.Config.FullBypass {
+		bypass = bypass || (xuid != "" && entry == xuid)
+	}
+	proxy.Config.RUnlock()
+
+	for {
+		players := atomic.LoadInt32(&proxy.players)
+		if max > 0 && players >= max && !bypass {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&proxy.players, players, players+1) {
+			return true
+		}
+	}
+}
+
+func (proxy *Proxy) releaseSlot() {
+	atomic.AddInt32(&proxy.players, -1)
+}
+
+// BypassesMaintenance reports whether the player with the username or XUID may join during maintenance.
+// Usernames are chosen by the client itself unless it is authenticated with XBOX Live, so they are only
+// matched for authenticated players.
+func (proxy *Proxy) BypassesMaintenance(username, xuid string, authenticated bool) bool {
+	if !authenticated {
+		username = ""
+	}
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return matchesPlayer(proxy.Config.MaintenanceBypass, username, xuid)
+}
+
+// matchesPlayer reports whether the list contains the XUID or the username, ignoring case. Empty values
+// never match.
+func matchesPlayer(list []string, username, xuid string) bool {
+	for _, entry := range list {
+		if (xuid != "" && entry == xuid) || (username != "" && strings.EqualFold(entry, username)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (proxy *Proxy) UIDs() []string {
 	var uids []string
 	for _, domain := range proxy.DomainNames() {
@@ -86,15 +241,60 @@ func (proxy *Proxy) UIDs() []string {
 }
 
 func proxyUID(domain, addr string) string {
-	return fmt.Sprintf("%s@%s", strings.ToLower(domain), addr)
+	// Lowercasing a regex would change its meaning, e.g. \S into \s, regexes are matched case-insensitive instead
+	if !strings.HasPrefix(domain, regexDomainPrefix) {
+		domain = strings.ToLower(domain)
+	}
+	return fmt.Sprintf("%s@%s", domain, addr)
 }
 
-func (proxy *Proxy) Dial() (*raknet.Conn, error) {
-	c, err := proxy.Dialer.Dial(proxy.Config.ProxyTo)
-	if err != nil {
-		return nil, err
+func (proxy *Proxy) Dial(addr string) (*raknet.Conn, error) {
+	return proxy.Dialer.DialTimeout(addr, proxy.Timeout())
+}
+
+// dialer returns the dialer for the backend connection of conn. With the PROXY protocol enabled it is a
+// copy of the proxy dialer that sends the address of conn, so concurrent logins don't share a header.
+func (proxy *Proxy) dialer(conn protocol.ProcessedConn) raknet.Dialer {
+	dialer := proxy.Dialer
+	if proxy.ProxyProtocol() {
+		dialer.UpstreamDialer = &proxyProtocolDialer{
+			connAddr: conn.RemoteAddr,
+			upstreamDialer: &net.Dialer{
+				Timeout: 5 * time.Second,
+				LocalAddr: &net.UDPAddr{
+					IP: net.ParseIP(proxy.ProxyBind()),
+				},
+			},
+		}
+	}
+	return dialer
+}
+
+// Status pings the backend of the proxy and returns its pong. Results are cached for PingCacheTTL.
+func (proxy *Proxy) Status() (*pong, error) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if time.Now().Before(proxy.statusExpiry) {
+		return proxy.status, proxy.statusErr
+	}
+
+	proxy.status, proxy.statusErr = nil, nil
+	backends := proxy.Backends()
+	backend := backends[0]
+	for _, b := range backends {
+		if b.Healthy() {
+			backend = b
+			break
+		}
+	}
+	b, err := raknet.PingTimeout(backend.Address, proxy.Timeout())
+	if err == nil {
+		proxy.status, err = parsePong(b)
 	}
-	return c, err
+	proxy.statusErr = err
+	proxy.statusExpiry = time.Now().Add(proxy.PingCacheTTL())
+	return proxy.status, proxy.statusErr
 }
 
 type proxyProtocolDialer struct {
@@ -124,31 +324,35 @@ func (d proxyProtocolDialer) Dial(network, address string) (net.Conn, error) {
 }
 
 func (proxy *Proxy) HandleLogin(conn protocol.ProcessedConn) error {
-	if proxy.ProxyProtocol() {
-		proxy.Dialer = raknet.Dialer{
-			UpstreamDialer: &net.Dialer{
-				Timeout: 5 * time.Second,
-				LocalAddr: &net.UDPAddr{
-					IP: net.ParseIP(proxy.ProxyBind()),
-				},
-			},
-		}
-		proxy.Dialer.UpstreamDialer = &proxyProtocolDialer{
-			connAddr:       conn.RemoteAddr,
-			upstreamDialer: proxy.Dialer.UpstreamDialer,
-		}
+	if !proxy.reserveSlot(conn.XUID) {
+		return proxy.rejectFull(conn)
+	}
+	defer proxy.releaseSlot()
+	return proxy.handleLogin(conn, nil, newSession(conn, proxy.UID))
+}
+
+// rejectFull disconnects a player that didn't get a slot of the proxy.
+func (proxy *Proxy) rejectFull(conn protocol.ProcessedConn) error {
+	if GammaConfig().Debug {
+		log.Printf("[i] %s rejected; %s is full", conn.RemoteAddr, proxy.DomainName())
 	}
+	return conn.Disconnect(proxy.FullMessage())
+}
 
-	rc, err := proxy.Dial()
+// handleLogin relays the connection of a player to a backend, the player must hold a slot of the proxy.
+func (proxy *Proxy) handleLogin(conn protocol.ProcessedConn, route *route, session *Session) error {
+	backend, rc, err := proxy.dialBackend(proxy.dialer(conn), route, session)
 	if err != nil {
-		log.Printf("[i] %s did not respond to ping; is the target offline?", proxy.ProxyTo())
 		err := conn.Disconnect(proxy.DisconnectMessage())
 		if err != nil {
 			return err
 		}
 		return nil
 	}
+	defer backend.addSession(-1)
 	defer rc.Close()
+	session.setBackend(route.expand(backend.Address), rc)
+	proxy.events.publish(session.event(EventPlayerRouted))
 
 	if _, err := rc.Write(conn.NetworkBytes); err != nil {
 		rc.Close()
@@ -166,6 +370,8 @@ func (proxy *Proxy) HandleLogin(conn protocol.ProcessedConn) error {
 	}
 	playersConnected.With(prometheus.Labels{"host": proxy.DomainName()}).Inc()
 	defer playersConnected.With(prometheus.Labels{"host": proxy.DomainName()}).Dec()
+	backendPlayersConnected.With(prometheus.Labels{"host": proxy.DomainName(), "backend": backend.Address}).Inc()
+	defer backendPlayersConnected.With(prometheus.Labels{"host": proxy.DomainName(), "backend": backend.Address}).Dec()
 
 	go func() {
 		for {
@@ -173,7 +379,9 @@ func (proxy *Proxy) HandleLogin(conn protocol.ProcessedConn) error {
 			if err != nil {
 				return
 			}
-			_, err = conn.Write(pk)
+			session.markRelayed()
+			n, err := conn.Write(pk)
+			session.addBytesToClient(n)
 			if err != nil {
 				return
 			}
@@ -184,6 +392,7 @@ func (proxy *Proxy) HandleLogin(conn protocol.ProcessedConn) error {
 		if err != nil {
 			return err
 		}
+		session.addBytesFromClient(len(pk))
 		_, err = rc.Write(pk)
 		if err != nil {
 			return err
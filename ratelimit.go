@@ -0,0 +1,240 @@
+package gamma
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitIP     = "ip"
+	RateLimitPrefix = "prefix"
+	RateLimitGlobal = "global"
+	// RateLimitUnknown drops IPs without a recent login while under attack
+	RateLimitUnknown = "unknown"
+)
+
+// errRateLimited is returned by serve for connections that are dropped by the rate limits once the PROXY
+// protocol header revealed the address of the client
+var errRateLimited = errors.New("rate limited")
+
+const (
+	// rateLimitSweepInterval is how often idle buckets are removed from the limiter
+	rateLimitSweepInterval = time.Minute
+	// maxRateLimitBuckets caps the ip and the prefix buckets of a limiter, so that spoofed source addresses
+	// can't grow it without bound between sweeps
+	maxRateLimitBuckets = 65536
+	// rateLimitFullSweepInterval is how often a limiter with the maximum number of buckets is swept
+	rateLimitFullSweepInterval = time.Second
+)
+
+var (
+	rateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gamma_ratelimited_total",
+		Help: "The total number of connections and pings dropped by the rate limiter per listener and limit",
+	}, []string{"listener", "reason"})
+)
+
+// RateLimitConfig limits the new connections accepted by the gateway. IP limits every source address,
+// Prefix every /24 (IPv4) or /48 (IPv6) network and Global all connections together.
+type RateLimitConfig struct {
+	Enabled bool      `yaml:"enabled"`
+	IP      RateLimit `yaml:"ip"`
+	Prefix  RateLimit `yaml:"prefix"`
+	Global  RateLimit `yaml:"global"`
+}
+
+// RateLimit is a token bucket that allows Rate connections per second with bursts of up to Burst
+// connections. A Rate of 0 disables the limit.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// burst returns the size of the bucket, which holds at least one token.
+func (limit RateLimit) burst() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill, it returns false if the bucket has no token left.
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) bool {
+	burst := limit.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+// full reports whether the bucket would be full at now, full buckets can be forgotten.
+func (b *tokenBucket) full(now time.Time, limit RateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst()
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	global    tokenBucket
+	ips       map[string]*tokenBucket
+	prefixes  map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// ipPrefix returns the /24 network of an IPv4 or the /48 network of an IPv6 address.
+func ipPrefix(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// allow takes a token from every bucket the ip belongs to. If one of them is empty no token is taken
+// and the name of the exceeded limit is returned.
+func (l *rateLimiter) allow(ip net.IP, cfg RateLimitConfig) (bool, string) {
+	if !cfg.Enabled {
+		return true, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.ips == nil {
+		l.ips = map[string]*tokenBucket{}
+		l.prefixes = map[string]*tokenBucket{}
+	}
+	// Without an IP only the global bucket is checked, and cfg might not hold the per IP limits to sweep with
+	if ip != nil && (now.Sub(l.lastSweep) > rateLimitSweepInterval ||
+		(l.full() && now.Sub(l.lastSweep) > rateLimitFullSweepInterval)) {
+		l.sweep(now, cfg)
+	}
+
+	var buckets []*tokenBucket
+	check := func(b *tokenBucket, limit RateLimit, reason string) string {
+		if !b.refill(now, limit) {
+			return reason
+		}
+		buckets = append(buckets, b)
+		return ""
+	}
+
+	if ip != nil && cfg.IP.Rate > 0 {
+		if reason := check(bucket(l.ips, ip.String()), cfg.IP, RateLimitIP); reason != "" {
+			return false, reason
+		}
+	}
+	if ip != nil && cfg.Prefix.Rate > 0 {
+		if reason := check(bucket(l.prefixes, ipPrefix(ip)), cfg.Prefix, RateLimitPrefix); reason != "" {
+			return false, reason
+		}
+	}
+	if cfg.Global.Rate > 0 {
+		if reason := check(&l.global, cfg.Global, RateLimitGlobal); reason != "" {
+			return false, reason
+		}
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, ""
+}
+
+// full reports whether the ip or the prefix buckets reached maxRateLimitBuckets.
+func (l *rateLimiter) full() bool {
+	return len(l.ips) >= maxRateLimitBuckets || len(l.prefixes) >= maxRateLimitBuckets
+}
+
+// bucket returns the bucket of key in buckets, creating it if needed. If buckets already holds
+// maxRateLimitBuckets a random bucket is evicted to make room.
+func bucket(buckets map[string]*tokenBucket, key string) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok {
+		if len(buckets) >= maxRateLimitBuckets {
+			// Map iteration starts at a random key
+			for evict := range buckets {
+				delete(buckets, evict)
+				break
+			}
+		}
+		b = &tokenBucket{}
+		buckets[key] = b
+	}
+	return b
+}
+
+// sweep removes the buckets that refilled completely, so that the limiter doesn't grow with every
+// address that ever connected.
+func (l *rateLimiter) sweep(now time.Time, cfg RateLimitConfig) {
+	l.lastSweep = now
+	for key, b := range l.ips {
+		if b.full(now, cfg.IP) {
+			delete(l.ips, key)
+		}
+	}
+	for key, b := range l.prefixes {
+		if b.full(now, cfg.Prefix) {
+			delete(l.prefixes, key)
+		}
+	}
+}
+
+// The scopes of allowConn. Behind a PROXY protocol load balancer every connection comes from the address
+// of the balancer, so only the global limit is checked when accepting and the per client limits once the
+// header was read.
+const (
+	limitAll = iota
+	limitGlobal
+	limitClient
+)
+
+// allowConn reports whether a new connection from addr on the listener is within the rate limits of
+// scope. Rejected connections are counted and should be dropped without a response.
+func (gateway *Gateway) allowConn(addr net.Addr, listener string, scope int) bool {
+	var ip net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP
+	} else {
+		ip = net.ParseIP(clientIP(addr))
+	}
+
+	cfg := gateway.rateLimitConfig()
+	switch scope {
+	case limitGlobal:
+		ip = nil
+	case limitClient:
+		cfg.Global = RateLimit{}
+	}
+
+	ok, reason := gateway.limiter.allow(ip, cfg)
+	// The known IPs are client addresses, which are not known yet when only the global limit is checked
+	if ok && scope != limitGlobal && !gateway.allowUnknown(addr) {
+		ok, reason = false, RateLimitUnknown
+	}
+	if !ok {
+		rateLimitedCount.With(prometheus.Labels{"listener": listener, "reason": reason}).Inc()
+		if GammaConfig().Debug {
+			log.Printf("[!] Dropped %s on listener %s; reason: %s", addr, listener, reason)
+		}
+	}
+	return ok
+}
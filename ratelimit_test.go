@@ -0,0 +1,169 @@
+package gamma
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// slow is a limit that doesn't refill noticeably while a test runs.
+func slow(burst int) RateLimit {
+	return RateLimit{Rate: 0.001, Burst: burst}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 4}
+	now := time.Now()
+
+	var b tokenBucket
+	if !b.refill(now, limit) || b.tokens != 4 {
+		t.Fatalf("new bucket has %v tokens, want a full bucket of 4", b.tokens)
+	}
+	b.tokens = 0
+	if b.refill(now.Add(250*time.Millisecond), limit) {
+		t.Errorf("bucket with %v tokens has a token left", b.tokens)
+	}
+	if !b.refill(now.Add(time.Second), limit) || b.tokens != 2 {
+		t.Errorf("bucket has %v tokens after a second, want 2", b.tokens)
+	}
+	if b.refill(now.Add(time.Hour), limit); b.tokens != 4 {
+		t.Errorf("bucket has %v tokens after an hour, want the burst of 4", b.tokens)
+	}
+
+	var single tokenBucket
+	single.refill(now, RateLimit{Rate: 1})
+	if single.tokens != 1 {
+		t.Errorf("bucket without a burst has %v tokens, want 1", single.tokens)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, IP: slow(3)}
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		if ok, reason := l.allow(ip, cfg); !ok {
+			t.Fatalf("connection %v within the burst was rejected by the %s limit", i+1, reason)
+		}
+	}
+	if ok, reason := l.allow(ip, cfg); ok || reason != RateLimitIP {
+		t.Errorf("connection beyond the burst got %v, %q, want the ip limit", ok, reason)
+	}
+	if ok, _ := l.allow(net.ParseIP("198.51.100.1"), cfg); !ok {
+		t.Error("connection of another ip was rejected")
+	}
+	if ok, _ := l.allow(ip, RateLimitConfig{IP: slow(1)}); !ok {
+		t.Error("connection was rejected with the limiter disabled")
+	}
+}
+
+func TestRateLimiterRejectionTakesNoToken(t *testing.T) {
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, IP: slow(5), Prefix: slow(5), Global: slow(1)}
+	ip := net.ParseIP("192.0.2.1")
+
+	if ok, _ := l.allow(ip, cfg); !ok {
+		t.Fatal("first connection was rejected")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, reason := l.allow(ip, cfg); ok || reason != RateLimitGlobal {
+			t.Fatalf("got %v, %q, want the global limit", ok, reason)
+		}
+	}
+	if tokens := l.ips[ip.String()].tokens; tokens < 4 || tokens >= 4.1 {
+		t.Errorf("ip bucket has %v tokens, want 4", tokens)
+	}
+	if tokens := l.prefixes[ipPrefix(ip)].tokens; tokens < 4 || tokens >= 4.1 {
+		t.Errorf("prefix bucket has %v tokens, want 4", tokens)
+	}
+}
+
+func TestIPPrefix(t *testing.T) {
+	tests := []struct {
+		ip, other string
+		same      bool
+	}{
+		{"192.0.2.1", "192.0.2.254", true},
+		{"192.0.2.1", "192.0.3.1", false},
+		{"::ffff:192.0.2.1", "192.0.2.7", true},
+		{"2001:db8:1::1", "2001:db8:1:ffff::1", true},
+		{"2001:db8:1::1", "2001:db8:2::1", false},
+	}
+	for _, test := range tests {
+		if same := ipPrefix(net.ParseIP(test.ip)) == ipPrefix(net.ParseIP(test.other)); same != test.same {
+			t.Errorf("%s and %s in the same prefix: %v, want %v", test.ip, test.other, same, test.same)
+		}
+	}
+
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, Prefix: slow(2)}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if ok, _ := l.allow(net.ParseIP(ip), cfg); !ok {
+			t.Fatalf("connection of %s was rejected", ip)
+		}
+	}
+	if ok, reason := l.allow(net.ParseIP("192.0.2.3"), cfg); ok || reason != RateLimitPrefix {
+		t.Errorf("third connection of the /24 got %v, %q, want the prefix limit", ok, reason)
+	}
+	if ok, _ := l.allow(net.ParseIP("192.0.3.1"), cfg); !ok {
+		t.Error("connection of another /24 was rejected")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, IP: RateLimit{Rate: 1, Burst: 2}, Prefix: RateLimit{Rate: 1, Burst: 10}}
+	idle := net.ParseIP("192.0.2.1")
+	l.allow(idle, cfg)
+	busy := net.IPv4(198, 51, 100, 0)
+	for i := 1; i <= 8; i++ {
+		busy[15] = byte(i)
+		l.allow(busy, cfg)
+	}
+
+	// The ip buckets and the prefix of the idle ip are full after a second, the busy prefix after 8 seconds
+	l.sweep(time.Now().Add(5*time.Second), cfg)
+	if len(l.ips) != 0 {
+		t.Errorf("%v full ip buckets were not removed", len(l.ips))
+	}
+	if _, ok := l.prefixes[ipPrefix(idle)]; ok {
+		t.Error("full prefix bucket was not removed")
+	}
+	if _, ok := l.prefixes[ipPrefix(busy)]; !ok {
+		t.Error("prefix bucket that is not full was removed")
+	}
+}
+
+func TestRateLimiterGlobalOnly(t *testing.T) {
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, IP: slow(1), Prefix: slow(1), Global: slow(2)}
+
+	for i := 0; i < 2; i++ {
+		if ok, reason := l.allow(nil, cfg); !ok {
+			t.Fatalf("connection %v was rejected by the %s limit", i+1, reason)
+		}
+	}
+	if ok, reason := l.allow(nil, cfg); ok || reason != RateLimitGlobal {
+		t.Errorf("got %v, %q, want the global limit", ok, reason)
+	}
+	if len(l.ips) != 0 || len(l.prefixes) != 0 {
+		t.Errorf("limiter has %v ip and %v prefix buckets without an ip", len(l.ips), len(l.prefixes))
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	var l rateLimiter
+	cfg := RateLimitConfig{Enabled: true, IP: slow(1)}
+	ip := make(net.IP, net.IPv4len)
+	for i := 0; i < maxRateLimitBuckets+100; i++ {
+		ip[0], ip[1], ip[2], ip[3] = 10, byte(i>>16), byte(i>>8), byte(i)
+		l.allow(ip, cfg)
+	}
+	if len(l.ips) > maxRateLimitBuckets {
+		t.Errorf("limiter has %v ip buckets, the maximum is %v", len(l.ips), maxRateLimitBuckets)
+	}
+	if ok, reason := l.allow(ip, cfg); ok || reason != RateLimitIP {
+		t.Errorf("last ip got %v, %q, want the ip limit of its bucket", ok, reason)
+	}
+}
@@ -0,0 +1,96 @@
+package gamma
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// catchAllDomain matches every server address on a listener that no other proxy matched
+	catchAllDomain = "*"
+	// regexDomainPrefix marks a domain as a regular expression, e.g. "~(.+)\\.mc\\.example\\.com"
+	regexDomainPrefix = "~"
+)
+
+// route is the result of matching a server address against the proxies of a listener.
+type route struct {
+	proxy *Proxy
+	// re and match are set when the proxy was matched by a regex domain, its capture groups can be
+	// substituted into backend addresses
+	re    *regexp.Regexp
+	src   string
+	match []int
+}
+
+// expand substitutes the capture groups of the route, e.g. $1, into the address template.
+func (r *route) expand(template string) string {
+	if r == nil || r.re == nil {
+		return template
+	}
+	return string(r.re.ExpandString(nil, template, r.src, r.match))
+}
+
+// compileDomainRegex compiles a regex domain, anchored and case-insensitive.
+func (gateway *Gateway) compileDomainRegex(domain string) (*regexp.Regexp, error) {
+	if v, ok := gateway.regexps.Load(domain); ok {
+		return v.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(fmt.Sprintf("(?i)^(?:%s)$", strings.TrimPrefix(domain, regexDomainPrefix)))
+	if err != nil {
+		return nil, err
+	}
+	gateway.regexps.Store(domain, re)
+	return re, nil
+}
+
+// findRoute looks up the proxy for serverAddr on the listener addr. Exact domains take precedence over
+// wildcard domains, where the longest suffix wins, followed by regex domains in lexical order and
+// finally the catch-all domain.
+func (gateway *Gateway) findRoute(serverAddr, addr string) (*route, bool) {
+	serverAddr = strings.ToLower(serverAddr)
+
+	if v, ok := gateway.Proxies.Load(proxyUID(serverAddr, addr)); ok {
+		return &route{proxy: v.(*Proxy)}, true
+	}
+
+	labels := strings.Split(serverAddr, ".")
+	for i := 1; i < len(labels); i++ {
+		wildcard := "*." + strings.Join(labels[i:], ".")
+		if v, ok := gateway.Proxies.Load(proxyUID(wildcard, addr)); ok {
+			return &route{proxy: v.(*Proxy)}, true
+		}
+	}
+
+	suffix := "@" + addr
+	var regexUIDs []string
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		uid := k.(string)
+		if strings.HasPrefix(uid, regexDomainPrefix) && strings.HasSuffix(uid, suffix) {
+			regexUIDs = append(regexUIDs, uid)
+		}
+		return true
+	})
+	sort.Strings(regexUIDs)
+	for _, uid := range regexUIDs {
+		re, err := gateway.compileDomainRegex(strings.TrimSuffix(uid, suffix))
+		if err != nil {
+			continue
+		}
+		match := re.FindStringSubmatchIndex(serverAddr)
+		if match == nil {
+			continue
+		}
+		v, ok := gateway.Proxies.Load(uid)
+		if !ok {
+			continue
+		}
+		return &route{proxy: v.(*Proxy), re: re, src: serverAddr, match: match}, true
+	}
+
+	if v, ok := gateway.Proxies.Load(proxyUID(catchAllDomain, addr)); ok {
+		return &route{proxy: v.(*Proxy)}, true
+	}
+	return nil, false
+}
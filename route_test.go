@@ -0,0 +1,63 @@
+package gamma
+
+import "testing"
+
+func TestFindRoute(t *testing.T) {
+	const addr = ":19132"
+	var gateway Gateway
+	domains := []string{
+		"play.example.com",
+		"*.example.com",
+		"*.eu.example.com",
+		`~(\w+)\.mc\.example\.net`,
+		`~(\w+)\.(mc)\.example\.net`,
+		`~LOBBY\.example\.org`,
+		catchAllDomain,
+	}
+	for _, domain := range domains {
+		gateway.Proxies.Store(proxyUID(domain, addr), NewProxy(domain, &ProxyConfig{}))
+	}
+	gateway.Proxies.Store(proxyUID("other.example.io", ":19133"), NewProxy("other.example.io", &ProxyConfig{}))
+
+	tests := []struct {
+		name       string
+		serverAddr string
+		want       string
+		// expanded is the result of expanding "$1.internal:19132" with the route, if set
+		expanded string
+	}{
+		{"exact before wildcard", "play.example.com", "play.example.com", ""},
+		{"exact case folded", "PLAY.Example.com", "play.example.com", ""},
+		{"wildcard", "hub.example.com", "*.example.com", ""},
+		{"longest wildcard suffix", "hub.eu.example.com", "*.eu.example.com", ""},
+		{"wildcard case folded", "Hub.EU.example.com", "*.eu.example.com", ""},
+		{"regex in lexical order", "survival.mc.example.net", `~(\w+)\.(mc)\.example\.net`, "survival.internal:19132"},
+		{"regex case folded", "lobby.example.org", `~LOBBY\.example\.org`, ""},
+		{"regex is anchored", "survival.mc.example.net.evil", catchAllDomain, ""},
+		{"catch-all", "unknown.example.io", catchAllDomain, ""},
+		{"exact on another listener", "other.example.io", catchAllDomain, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, ok := gateway.findRoute(test.serverAddr, addr)
+			if !ok {
+				t.Fatalf("no route for %s", test.serverAddr)
+			}
+			if r.proxy.UID != test.want {
+				t.Errorf("routed %s to %s, want %s", test.serverAddr, r.proxy.UID, test.want)
+			}
+			if test.expanded != "" {
+				if got := r.expand("$1.internal:19132"); got != test.expanded {
+					t.Errorf("expanded to %s, want %s", got, test.expanded)
+				}
+			}
+		})
+	}
+
+	if _, ok := gateway.findRoute("play.example.com", ":19134"); ok {
+		t.Error("found a route on a listener without proxies")
+	}
+	if r, _ := gateway.findRoute("hub.example.com", addr); r.expand("$1:19132") != "$1:19132" {
+		t.Error("route without a regex expanded the template")
+	}
+}
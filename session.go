@@ -0,0 +1,238 @@
+package gamma
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/lhridder/gamma/protocol"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKickMessage is shown to kicked players if no message was given
+const DefaultKickMessage = "You have been kicked from the server."
+
+// Session is a player that is being proxied by the gateway.
+type Session struct {
+	ID          string
+	Username    string
+	XUID        string
+	UUID        string
+	ClientIP    string
+	Proxy       string
+	ConnectedAt time.Time
+
+	client protocol.ProcessedConn
+
+	mu          sync.RWMutex
+	backend     string
+	backendConn *raknet.Conn
+	// relayed is set to 1 once the first packet of the backend was relayed to the client, after which the
+	// connection may be encrypted and the gateway can no longer send packets to the client
+	relayed int32
+
+	bytesFromClient uint64
+	bytesToClient   uint64
+}
+
+// SessionInfo is a snapshot of a Session.
+type SessionInfo struct {
+	ID              string    `json:"id"`
+	Username        string    `json:"username"`
+	XUID            string    `json:"xuid"`
+	UUID            string    `json:"uuid"`
+	ClientIP        string    `json:"clientIp"`
+	Proxy           string    `json:"proxy"`
+	Backend         string    `json:"backend"`
+	ConnectedAt     time.Time `json:"connectedAt"`
+	BytesFromClient uint64    `json:"bytesFromClient"`
+	BytesToClient   uint64    `json:"bytesToClient"`
+	// Latency is the raknet latency to the client in milliseconds
+	Latency int64 `json:"latency"`
+}
+
+func newSession(client protocol.ProcessedConn, proxy string) *Session {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	return &Session{
+		ID:          hex.EncodeToString(id),
+		Username:    client.Username,
+		XUID:        client.XUID,
+		UUID:        client.UUID,
+		ClientIP:    clientIP(client.RemoteAddr),
+		Proxy:       proxy,
+		ConnectedAt: time.Now(),
+		client:      client,
+	}
+}
+
+// clientIP returns the IP of addr without the port.
+func clientIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// Backend returns the address of the backend the session is connected to, if any.
+func (session *Session) Backend() string {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return session.backend
+}
+
+func (session *Session) setBackend(addr string, conn *raknet.Conn) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.backend = addr
+	session.backendConn = conn
+}
+
+func (session *Session) markRelayed() {
+	atomic.StoreInt32(&session.relayed, 1)
+}
+
+// Kick disconnects the client and the backend of the session. The client is shown msg if the backend did
+// not start the encryption handshake yet, otherwise the connection is just closed.
+func (session *Session) Kick(msg string) {
+	if msg == "" {
+		msg = DefaultKickMessage
+	}
+
+	session.mu.RLock()
+	backendConn := session.backendConn
+	session.mu.RUnlock()
+
+	if atomic.LoadInt32(&session.relayed) == 0 {
+		_ = session.client.Disconnect(msg)
+	} else {
+		_ = session.client.Close()
+	}
+	if backendConn != nil {
+		_ = backendConn.Close()
+	}
+}
+
+func (session *Session) addBytesFromClient(n int) {
+	atomic.AddUint64(&session.bytesFromClient, uint64(n))
+}
+
+func (session *Session) addBytesToClient(n int) {
+	atomic.AddUint64(&session.bytesToClient, uint64(n))
+}
+
+// Info returns a snapshot of the session.
+func (session *Session) Info() SessionInfo {
+	info := SessionInfo{
+		ID:              session.ID,
+		Username:        session.Username,
+		XUID:            session.XUID,
+		UUID:            session.UUID,
+		ClientIP:        session.ClientIP,
+		Proxy:           session.Proxy,
+		Backend:         session.Backend(),
+		ConnectedAt:     session.ConnectedAt,
+		BytesFromClient: atomic.LoadUint64(&session.bytesFromClient),
+		BytesToClient:   atomic.LoadUint64(&session.bytesToClient),
+	}
+	if session.client.Conn != nil {
+		info.Latency = session.client.Latency().Milliseconds()
+	}
+	return info
+}
+
+func (gateway *Gateway) addSession(session *Session) {
+	gateway.sessions.Store(session.ID, session)
+}
+
+func (gateway *Gateway) removeSession(session *Session) {
+	gateway.sessions.Delete(session.ID)
+}
+
+// Session returns the session with the id.
+func (gateway *Gateway) Session(id string) (*Session, bool) {
+	v, ok := gateway.sessions.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Session), true
+}
+
+// Sessions returns a snapshot of all sessions, oldest first.
+func (gateway *Gateway) Sessions() []SessionInfo {
+	return gateway.filterSessions(func(*Session) bool { return true })
+}
+
+// ProxySessions returns a snapshot of the sessions of the proxy with the name, oldest first.
+func (gateway *Gateway) ProxySessions(name string) []SessionInfo {
+	return gateway.filterSessions(func(session *Session) bool {
+		return session.Proxy == name
+	})
+}
+
+func (gateway *Gateway) filterSessions(keep func(*Session) bool) []SessionInfo {
+	sessions := []SessionInfo{}
+	gateway.sessions.Range(func(k, v interface{}) bool {
+		session := v.(*Session)
+		if keep(session) {
+			sessions = append(sessions, session.Info())
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	return sessions
+}
+
+// KickSession kicks the session with the id and reports whether it existed.
+func (gateway *Gateway) KickSession(id, msg string) bool {
+	session, ok := gateway.Session(id)
+	if ok {
+		session.Kick(msg)
+	}
+	return ok
+}
+
+// KickPlayer kicks every session of the player with the username, ignoring case, and returns the number
+// of kicked sessions.
+func (gateway *Gateway) KickPlayer(username, msg string) int {
+	return gateway.kick(func(session *Session) bool {
+		return strings.EqualFold(session.Username, username)
+	}, msg)
+}
+
+// KickProxy kicks every session of the proxy with the name and returns the number of kicked sessions.
+func (gateway *Gateway) KickProxy(name, msg string) int {
+	return gateway.kick(func(session *Session) bool {
+		return session.Proxy == name
+	}, msg)
+}
+
+// KickIP kicks every session of the client IP and returns the number of kicked sessions.
+func (gateway *Gateway) KickIP(ip, msg string) int {
+	return gateway.kick(func(session *Session) bool {
+		return session.ClientIP == ip
+	}, msg)
+}
+
+func (gateway *Gateway) kick(match func(*Session) bool, msg string) int {
+	n := 0
+	gateway.sessions.Range(func(k, v interface{}) bool {
+		session := v.(*Session)
+		if match(session) {
+			log.Printf("[i] Kicking %s (%s) from %s", session.Username, session.ClientIP, session.Proxy)
+			session.Kick(msg)
+			n++
+		}
+		return true
+	})
+	return n
+}
@@ -0,0 +1,110 @@
+package gamma
+
+import (
+	"net/http"
+	"sort"
+)
+
+// ListenerStatus is the state of a listener that at least one registered proxy listens to.
+type ListenerStatus struct {
+	Address string   `json:"address"`
+	Bound   bool     `json:"bound"`
+	Proxies []string `json:"proxies"`
+	Players int      `json:"players"`
+}
+
+// ListenerStatuses returns the status of every configured listener, sorted by address.
+func (gateway *Gateway) ListenerStatuses() []ListenerStatus {
+	addrs := map[string]bool{}
+	gateway.Proxies.Range(func(k, v interface{}) bool {
+		addrs[v.(*Proxy).ListenTo()] = true
+		return true
+	})
+
+	statuses := make([]ListenerStatus, 0, len(addrs))
+	for addr := range addrs {
+		_, bound := gateway.listeners.Load(addr)
+		names := []string{}
+		for _, proxy := range gateway.listenerProxies(addr) {
+			names = append(names, proxy.UID)
+		}
+		sort.Strings(names)
+		statuses = append(statuses, ListenerStatus{
+			Address: addr,
+			Bound:   bound,
+			Proxies: names,
+			Players: gateway.ListenerPlayers(addr),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// Ready reports whether the gateway accepts players. It is ready once all proxies of ListenAndServe
+// are registered and every configured listener is bound, and stops being ready when Shutdown begins.
+func (gateway *Gateway) Ready() (bool, string) {
+	gateway.mu.Lock()
+	ready, closing := gateway.ready, gateway.closing
+	gateway.mu.Unlock()
+
+	if closing {
+		return false, "shutting down"
+	}
+	if !ready {
+		return false, "starting"
+	}
+	for _, status := range gateway.ListenerStatuses() {
+		if !status.Bound {
+			return false, "listener " + status.Address + " is not bound"
+		}
+	}
+	return true, "ready"
+}
+
+func (gateway *Gateway) setReady() {
+	gateway.mu.Lock()
+	gateway.ready = true
+	gateway.mu.Unlock()
+}
+
+// registerStatusRoutes registers the health routes on mux. They are served by both the API and the
+// Prometheus endpoint so orchestrators can probe whichever one is enabled.
+func (gateway *Gateway) registerStatusRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", gateway.handleHealthz)
+	mux.HandleFunc("/readyz", gateway.handleReadyz)
+	mux.HandleFunc("/listeners", gateway.handleListeners)
+}
+
+// handleHealthz serves GET /healthz, it succeeds as long as the process is alive.
+func (gateway *Gateway) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeResponse(w, http.StatusOK, "alive")
+}
+
+// handleReadyz serves GET /readyz.
+func (gateway *Gateway) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ready, reason := gateway.Ready()
+	if !ready {
+		writeResponse(w, http.StatusServiceUnavailable, reason)
+		return
+	}
+	writeResponse(w, http.StatusOK, reason)
+}
+
+// handleListeners serves GET /listeners.
+func (gateway *Gateway) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, gateway.ListenerStatuses())
+}